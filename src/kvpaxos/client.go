@@ -2,19 +2,31 @@ package kvpaxos
 
 import "net/rpc"
 import "time"
-
-import "math/rand"
+import "sync"
+import "crypto/rand"
+import "math/big"
 
 type Clerk struct {
   servers []string
   // You will have to modify this struct.
+  mu sync.Mutex
+  clientId int64
+  // the seq of the latest request; servers remember the
+  // reply to it, so a retry gets the original result
+  seq int64
 }
 
+func nrand() int64 {
+  max := big.NewInt(int64(1) << 62)
+  bigx, _ := rand.Int(rand.Reader, max)
+  return bigx.Int64()
+}
 
 func MakeClerk(servers []string) *Clerk {
   ck := new(Clerk)
   ck.servers = servers
   // You'll have to add code here.
+  ck.clientId = nrand()
   return ck
 }
 
@@ -55,18 +67,19 @@ func call(srv string, rpcname string,
 // keeps trying forever in the face of all other errors.
 //
 func (ck *Clerk) Get(key string) string {
+  // one request at a time, so that the servers only
+  // need to remember the latest one of each clerk
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+  ck.seq++
 
   for {
     // try each known server.
     for _, srv := range ck.servers {
-      // generate an new id for each read request
-      // there can be multiple read ops on the log
-      // but the client only need to return the first
-      // one it receives from the server
-      reqId := rand.Int63n(time.Now().UnixNano())
       args := &GetArgs{}
       args.Key = key
-      args.ReqId = reqId
+      args.ClientId = ck.clientId
+      args.Seq = ck.seq
       var reply GetReply
       ok := call(srv, "KVPaxos.Get", args, &reply)
       if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
@@ -84,15 +97,17 @@ func (ck *Clerk) Get(key string) string {
 // keeps trying until it succeeds.
 //
 func (ck *Clerk) Put(key string, value string) {
-  // a unique id is generated to make sure that the write only happens once
-  reqId := rand.Int63n(time.Now().UnixNano())
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+  ck.seq++
 
   for {
     for _, srv := range ck.servers {
       args := &PutArgs{}
       args.Key = key
       args.Value = value
-      args.ReqId = reqId
+      args.ClientId = ck.clientId
+      args.Seq = ck.seq
       var reply PutReply
       ok := call(srv, "KVPaxos.Put", args, &reply)
       if ok && reply.Err == OK {
@@ -102,3 +117,110 @@ func (ck *Clerk) Put(key string, value string) {
     time.Sleep(100 * time.Millisecond)
   }
 }
+
+//
+// append value to the value of a key.
+// keeps trying until it succeeds.
+//
+func (ck *Clerk) Append(key string, value string) {
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+  ck.seq++
+
+  for {
+    for _, srv := range ck.servers {
+      args := &AppendArgs{}
+      args.Key = key
+      args.Value = value
+      args.ClientId = ck.clientId
+      args.Seq = ck.seq
+      var reply AppendReply
+      ok := call(srv, "KVPaxos.Append", args, &reply)
+      if ok && reply.Err == OK {
+        return
+      }
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+}
+
+//
+// set the value for a key to hash(previous value + value),
+// and return the previous value ("" if there was none).
+// keeps trying until it succeeds.
+//
+func (ck *Clerk) PutHash(key string, value string) string {
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+  ck.seq++
+
+  for {
+    for _, srv := range ck.servers {
+      args := &PutHashArgs{}
+      args.Key = key
+      args.Value = value
+      args.ClientId = ck.clientId
+      args.Seq = ck.seq
+      var reply PutHashReply
+      ok := call(srv, "KVPaxos.PutHash", args, &reply)
+      if ok && reply.Err == OK {
+        return reply.PreviousValue
+      }
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+}
+
+//
+// set the value for a key to value if it is expected;
+// a key that does not exist matches "". returns whether
+// the value was set, and the value the key had.
+// keeps trying until it succeeds.
+//
+func (ck *Clerk) CompareAndSwap(key string, expected string, value string) (bool, string) {
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+  ck.seq++
+
+  for {
+    for _, srv := range ck.servers {
+      args := &CompareAndSwapArgs{}
+      args.Key = key
+      args.Expected = expected
+      args.Value = value
+      args.ClientId = ck.clientId
+      args.Seq = ck.seq
+      var reply CompareAndSwapReply
+      ok := call(srv, "KVPaxos.CompareAndSwap", args, &reply)
+      if ok && (reply.Err == OK || reply.Err == ErrMismatch) {
+        return reply.Err == OK, reply.Value
+      }
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+}
+
+//
+// delete a key. returns false if it did not exist.
+// keeps trying until it succeeds.
+//
+func (ck *Clerk) Delete(key string) bool {
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+  ck.seq++
+
+  for {
+    for _, srv := range ck.servers {
+      args := &DeleteArgs{}
+      args.Key = key
+      args.ClientId = ck.clientId
+      args.Seq = ck.seq
+      var reply DeleteReply
+      ok := call(srv, "KVPaxos.Delete", args, &reply)
+      if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
+        return reply.Err == OK
+      }
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+}
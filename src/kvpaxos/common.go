@@ -1,8 +1,12 @@
 package kvpaxos
 
+import "hash/fnv"
+
 const (
   OK = "OK"
   ErrNoKey = "ErrNoKey"
+  ErrBehind = "ErrBehind"
+  ErrMismatch = "ErrMismatch"
 )
 type Err string
 
@@ -10,20 +14,103 @@ type PutArgs struct {
   // You'll have to add definitions here.
   Key string
   Value string
-  ReqId int64
+  ClientId int64
+  Seq int64
 }
 
 type PutReply struct {
   Err Err
 }
 
+type AppendArgs struct {
+  Key string
+  Value string
+  ClientId int64
+  Seq int64
+}
+
+type AppendReply struct {
+  Err Err
+}
+
+//
+// PutHash sets the value of Key to hash(previous value +
+// Value), and replies with the previous value.
+//
+type PutHashArgs struct {
+  Key string
+  Value string
+  ClientId int64
+  Seq int64
+}
+
+type PutHashReply struct {
+  Err Err
+  PreviousValue string
+}
+
+//
+// sets Key to Value if its value is Expected; a key that
+// does not exist matches "". replies ErrMismatch and the
+// current value otherwise.
+//
+type CompareAndSwapArgs struct {
+  Key string
+  Expected string
+  Value string
+  ClientId int64
+  Seq int64
+}
+
+type CompareAndSwapReply struct {
+  Err Err
+  Value string
+}
+
+type DeleteArgs struct {
+  Key string
+  ClientId int64
+  Seq int64
+}
+
+type DeleteReply struct {
+  Err Err
+}
+
 type GetArgs struct {
   // You'll have to add definitions here.
   Key string
-  ReqId int64
+  ClientId int64
+  Seq int64
 }
 
 type GetReply struct {
   Err Err
   Value string
 }
+
+type SnapshotArgs struct {
+  // the caller needs the state with instances <= Seq applied
+  Seq int
+}
+
+type SnapshotReply struct {
+  Err Err
+  Applied int
+  Data map[string]string
+  Dups map[int64]DupEntry
+}
+
+type AppliedArgs struct {
+}
+
+type AppliedReply struct {
+  // the seq of the latest applied log instance
+  Applied int
+}
+
+func hash(s string) uint32 {
+  h := fnv.New32a()
+  h.Write([]byte(s))
+  return h.Sum32()
+}
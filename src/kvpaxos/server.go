@@ -11,11 +11,18 @@ import "syscall"
 import "encoding/gob"
 import "math/rand"
 import "time"
+import "strconv"
 
 const (
   OpInvalid = "OpInvalid"
   OpRead = "OpRead"
   OpWrite = "OpWrite"
+  OpAppend = "OpAppend"
+  OpPutHash = "OpPutHash"
+  OpCompareAndSwap = "OpCompareAndSwap"
+  OpDelete = "OpDelete"
+  // a read lease for server -1 - ClientId, see StartLeaseServer()
+  OpLease = "OpLease"
 )
 
 type OpType string
@@ -24,17 +31,30 @@ type Op struct {
   // Your definitions here.
   // Field names must start with capital letters,
   // otherwise RPC will break.
-  ReqId int64
+  ClientId int64
+  Seq int64
   OpType OpType
   Key string
   Value string
+  // OpCompareAndSwap only
+  Expected string
 }
 
-type PendingRead struct {
-  reqId int64
-  seq int
-  commited bool
-  done chan *string
+type Result struct {
+  Err Err
+  Value string
+}
+
+// identifies a request: the clerk and its seq
+type OpId struct {
+  ClientId int64
+  Seq int64
+}
+
+// the latest request applied for a clerk, and its result
+type DupEntry struct {
+  Seq int64
+  Result Result
 }
 
 type KVPaxos struct {
@@ -44,37 +64,66 @@ type KVPaxos struct {
   dead bool // for testing
   unreliable bool // for testing
   px *paxos.Paxos
+  servers []string
 
   // Your definitions here.
   data map[string]string
   // the seq number of the latest applied log instance
   applied int
-  // pending read requests
-  pendingRead map[int64]*PendingRead
+  // handlers waiting for their op to be applied
+  waiters map[OpId][]chan Result
+  // one entry per clerk, by ClientId
+  dups map[int64]DupEntry
+  batcher *paxos.Batcher
+
+  // read leases, disabled if leaseTime is 0
+  leaseTime time.Duration
+  // this server's own lease, the time each of its lease
+  // requests was made, and the latest Get it received
+  leaseUntil time.Time
+  leaseStarts map[int64]time.Time
+  leaseSeq int64
+  lastRead time.Time
+  // when the leases of the other servers expire, as far
+  // as this server knows
+  leases map[int]time.Time
+}
+
+const (
+  // how long ops are gathered before they are proposed
+  BatchWindow = 2 * time.Millisecond
+)
+
+func sameOp(a interface{}, b interface{}) bool {
+  return a.(Op).Id() == b.(Op).Id()
+}
+
+func (op Op) Id() OpId {
+  return OpId{ op.ClientId, op.Seq }
 }
 
-func (kv *KVPaxos) WaitLog(seq int, timeout time.Duration) (bool, *Op) {
+func (kv *KVPaxos) WaitLog(seq int, timeout time.Duration) (bool, *paxos.Batch) {
   start := time.Now()
   sleepms := 10 * time.Millisecond
   maxsleep := time.Second
 
   for !kv.dead {
     decided, val := kv.px.Status(seq)
-    var op *Op = nil
+    var batch *paxos.Batch = nil
     if val != nil {
-      obj := val.(Op)
-      op = &obj
+      obj := val.(paxos.Batch)
+      batch = &obj
     }
 
     if decided {
-      return true, op
+      return true, batch
     }
 
     if timeout > 0 {
       now := time.Now()
       elasped := now.Sub(start)
       if elasped.Milliseconds() >= timeout.Milliseconds() {
-        return false, op
+        return false, batch
       }
 
       remaining := timeout - elasped
@@ -92,163 +141,413 @@ func (kv *KVPaxos) WaitLog(seq int, timeout time.Duration) (bool, *Op) {
   return false, nil
 }
 
-func (kv *KVPaxos) AssignNewSeqToNewRequest(reqId int64, opType OpType) int {
+//
+// propose op and wait until the background worker has
+// applied it. a zero Result means the server is dead.
+//
+func (kv *KVPaxos) AppendOp(op Op) Result {
+  done := make(chan Result, 1)
   kv.mu.Lock()
-  defer kv.mu.Unlock()
-  maxSeq := kv.px.Max()
-  nextSeq := maxSeq + 1
-  if opType == OpRead {
-    pendingRead, ok := kv.pendingRead[reqId]
-    if ok {
-      pendingRead.seq = nextSeq
-    } else {
-      kv.pendingRead[reqId] = &PendingRead{ reqId, nextSeq, false, make(chan *string) }
+  kv.waiters[op.Id()] = append(kv.waiters[op.Id()], done)
+  kv.mu.Unlock()
+
+  seq := kv.batcher.Submit(op)
+  log.Printf("[kv][%d] committed %+v, seq %d", kv.me, op, seq)
+
+  for !kv.dead {
+    select {
+    case result := <- done:
+      kv.WaitLeases(seq)
+      return result
+    case <- time.After(paxos.LongWait * time.Millisecond):
+    }
+    // seq was skipped by installing a snapshot; the
+    // result is lost, so let the client retry.
+    kv.mu.Lock()
+    skipped := kv.applied >= seq
+    if skipped {
+      kv.DropWaiter(op.Id(), done)
+    }
+    kv.mu.Unlock()
+    if skipped {
+      select {
+      case result := <- done:
+        return result
+      default:
+        return Result{}
+      }
     }
   }
-  return nextSeq
+  return Result{}
 }
 
-func (kv *KVPaxos) MarkPendingReadCommitted(reqId int64) *PendingRead {
-  kv.mu.Lock()
-  defer kv.mu.Unlock()
-  pendingRead, ok := kv.pendingRead[reqId]
-  if ok {
-    pendingRead.commited = true
+//
+// stop waiting on done for the op with id.
+// hold kv.mu before call this func
+//
+func (kv *KVPaxos) DropWaiter(id OpId, done chan Result) {
+  waiters := kv.waiters[id]
+  for i, w := range waiters {
+    if w == done {
+      waiters = append(waiters[:i], waiters[i+1:]...)
+      break
+    }
+  }
+  if len(waiters) == 0 {
+    delete(kv.waiters, id)
+  } else {
+    kv.waiters[id] = waiters
   }
-  return pendingRead
 }
 
-func (kv *KVPaxos) GetPendingRead(reqId int64) *PendingRead {
-  kv.mu.Lock()
-  defer kv.mu.Unlock()
-  pendingRead := kv.pendingRead[reqId]
-  return pendingRead
+//
+// apply op unless it was applied before. a clerk sends
+// one request at a time, so only its latest one can be
+// retried; the result of an older one is not needed.
+//
+func (kv *KVPaxos) ApplyOp(op Op) Result {
+  last, ok := kv.dups[op.ClientId]
+  if ok && op.Seq <= last.Seq {
+    log.Printf("[kv][%d] duplicate op %+v, latest seq %d", kv.me, op, last.Seq)
+    if op.Seq == last.Seq {
+      return last.Result
+    }
+    return Result{}
+  }
+
+  result := kv.DoOp(op)
+  kv.dups[op.ClientId] = DupEntry{ op.Seq, result }
+  return result
 }
 
-func (kv *KVPaxos) RemovePendingRead(reqId int64) *PendingRead {
-  kv.mu.Lock()
-  defer kv.mu.Unlock()
-  pendingRead := kv.pendingRead[reqId]
-  delete(kv.pendingRead, reqId)
-  return pendingRead
+func (kv *KVPaxos) DoOp(op Op) Result {
+  if op.OpType == OpRead {
+    val, ok := kv.data[op.Key]
+    log.Printf("[kv][%d] read key %s val %s", kv.me, op.Key, val)
+    if ok {
+      return Result{ OK, val }
+    }
+    return Result{ ErrNoKey, "" }
+  } else if op.OpType == OpWrite {
+    kv.data[op.Key] = op.Value
+    log.Printf("[kv][%d] write key %s val %s", kv.me, op.Key, op.Value)
+    return Result{ OK, "" }
+  } else if op.OpType == OpAppend {
+    kv.data[op.Key] += op.Value
+    log.Printf("[kv][%d] append key %s val %s", kv.me, op.Key, op.Value)
+    return Result{ OK, "" }
+  } else if op.OpType == OpPutHash {
+    prev := kv.data[op.Key]
+    kv.data[op.Key] = strconv.Itoa(int(hash(prev + op.Value)))
+    log.Printf("[kv][%d] puthash key %s val %s", kv.me, op.Key, op.Value)
+    return Result{ OK, prev }
+  } else if op.OpType == OpCompareAndSwap {
+    cur := kv.data[op.Key]
+    if cur != op.Expected {
+      log.Printf("[kv][%d] cas key %s mismatch, expected %s val %s", kv.me, op.Key, op.Expected, cur)
+      return Result{ ErrMismatch, cur }
+    }
+    kv.data[op.Key] = op.Value
+    log.Printf("[kv][%d] cas key %s val %s", kv.me, op.Key, op.Value)
+    return Result{ OK, cur }
+  } else if op.OpType == OpDelete {
+    if _, ok := kv.data[op.Key]; !ok {
+      return Result{ ErrNoKey, "" }
+    }
+    delete(kv.data, op.Key)
+    log.Printf("[kv][%d] delete key %s", kv.me, op.Key)
+    return Result{ OK, "" }
+  } else if op.OpType == OpLease {
+    kv.ApplyLease(op)
+    return Result{ OK, "" }
+  }
+  log.Printf("[kv][%d] committed invalid op %+v", kv.me, op)
+  return Result{}
 }
 
-func (kv *KVPaxos) GetMinSeqOfUncommittedRead() int {
+//
+// apply the ops of a decided batch in order, and hand
+// the results to the handlers waiting for them.
+//
+func (kv *KVPaxos) ApplyBatch(seq int, batch *paxos.Batch) {
   kv.mu.Lock()
   defer kv.mu.Unlock()
-  minSeq := kv.px.Max() + 1
-  var minPendingRead *PendingRead = nil
-  for _, pendingRead := range kv.pendingRead {
-    if pendingRead.commited { continue }
-    if minSeq < 0 || minSeq > pendingRead.seq {
-      minSeq = pendingRead.seq
-      minPendingRead = pendingRead
-    }
+
+  if seq != kv.applied + 1 {
+    // a snapshot was installed meanwhile
+    return
   }
-  log.Printf("[kv][%d] min uncommitted read %+v", kv.me, minPendingRead)
-  return minSeq
-}
 
-func (kv *KVPaxos) AppendOp(reqId int64, opType OpType, key string, val string) int {
-  op := Op{ reqId, opType, key, val }
-  for !kv.dead {
-    seq := kv.AssignNewSeqToNewRequest(reqId, opType)
-    kv.px.Start(seq, op)
-    decided, committed := kv.WaitLog(seq, 0)
-    // if it's decided but log entry is nil, the log has been removed
-    if decided && committed != nil && op.ReqId == committed.ReqId {
-      return seq
+  for _, v := range batch.Values {
+    op := v.(Op)
+    result := kv.ApplyOp(op)
+    for _, done := range kv.waiters[op.Id()] {
+      done <- result
     }
+    delete(kv.waiters, op.Id())
   }
-  return -1
+  kv.applied = seq
 }
 
 func (kv *KVPaxos) StartBackgroundWorker() {
   go func() {
     log.Printf("[kv][%d] background worker started", kv.me)
-    writeSeen := make(map[int64]bool)
     for !kv.dead {
-      uncommitted := -1
-      for !kv.dead {
-        uncommitted = kv.GetMinSeqOfUncommittedRead()
-        if kv.applied < uncommitted { break }
-        time.Sleep(10 * time.Millisecond)
-      }
-      log.Printf("[kv][%d] applied seq %d, min uncommitted seq %d", kv.me, kv.applied, uncommitted)
-      for seq := kv.applied + 1; !kv.dead && seq <= uncommitted; seq++ {
-        log.Printf("[kv][%d] wait for operation, seq %d", kv.me, seq)
-        decided, op := kv.WaitLog(seq, paxos.LongWait * time.Millisecond)
-        log.Printf("[kv][%d] get an operation %+v, decided %v, seq %d", kv.me, op, decided, seq)
-        if decided {
-          if op.OpType == OpRead {
-            pendingRead := kv.GetPendingRead(op.ReqId)
-            if pendingRead == nil { continue }
-            log.Printf("[kv][%d] pending read %+v", kv.me, pendingRead)
-            val, ok := kv.data[op.Key]
-            log.Printf("[kv][%d] read key %s val %s", kv.me, op.Key, val)
-            if ok {
-              pendingRead.done <- &val
-            } else {
-              pendingRead.done <- nil
-            }
-          } else if op.OpType == OpWrite {
-            if writeSeen[op.ReqId] {
-              log.Printf("[kv][%d] duplicate write key %s val %s", kv.me, op.Key, op.Value)
-            } else {
-              kv.data[op.Key] = op.Value
-              writeSeen[op.ReqId] = true
-              log.Printf("[kv][%d] write key %s val %s", kv.me, op.Key, op.Value)
-            }
+      seq := kv.applied + 1
+      log.Printf("[kv][%d] wait for operation, seq %d", kv.me, seq)
+      decided, batch := kv.WaitLog(seq, paxos.LongWait * time.Millisecond)
+      log.Printf("[kv][%d] get a batch %+v, decided %v, seq %d", kv.me, batch, decided, seq)
+      if decided {
+        if batch != nil {
+          kv.ApplyBatch(seq, batch)
+          kv.px.Done(seq)
+        } else if seq < kv.px.Min() {
+          // paxos has forgotten seq, so the ops
+          // can only come from a peer's state
+          kv.FetchSnapshot(seq)
+        }
+      } else {
+        // (1) if seq is greater than Max(), it could be a blank log instance
+        //     simply spend more time waiting for its completion
+        // (2) if seq is less or equal to Max(), it is an uncommitted log instance
+        //     the original proposer may have network issue, re-propose it to push forward
+        if seq <= kv.px.Max() {
+          log.Printf("[kv][%d] re-propose uncommitted batch %+v seq %d", kv.me, batch, seq)
+          if batch == nil {
+            log.Printf("[kv][%d] wait longer before re-proposing null op, seq %d", kv.me, seq)
+            kv.px.WaitForSomeMilliseconds(paxos.LongWait)
+            // try to put an empty log entry here to move forward
+            kv.px.Start(seq, paxos.Batch{})
           } else {
-            log.Printf("[kv][%d] committed invalid op %+v seq %d", kv.me, op, seq)
+            kv.px.Start(seq, *batch)
           }
-          kv.px.Done(seq)
-        } else {
-          // (1) if seq is greater than Max(), it could be a blank log instance
-          //     simply spend more time waiting for its completion
-          // (2) if seq is less or equal to Max(), it is an uncommitted log instance
-          //     the original proposer may have network issue, re-propose it to push forward
-          if seq <= kv.px.Max() {
-            log.Printf("[kv][%d] re-propose uncommitted op %+v seq %d", kv.me, op, seq)
-            if op == nil {
-              log.Printf("[kv][%d] wait longer before re-proposing null op, seq %d", kv.me, seq)
-              kv.px.WaitForSomeMilliseconds(paxos.LongWait)
-              // try to put an empty log entry here to move forward
-              kv.px.Start(seq, Op{})
-            } else {
-              kv.px.Start(seq, *op)
+        }
+      }
+    }
+  }()
+}
+
+//
+// copy the state of a peer that has applied seq, and
+// continue applying the log from where that peer is.
+//
+func (kv *KVPaxos) FetchSnapshot(seq int) {
+  for !kv.dead {
+    for i, srv := range kv.servers {
+      if i == kv.me { continue }
+      args := &SnapshotArgs{ seq }
+      var reply SnapshotReply
+      ok := call(srv, "KVPaxos.Snapshot", args, &reply)
+      if !ok || reply.Err != OK { continue }
+
+      kv.mu.Lock()
+      if reply.Applied > kv.applied {
+        log.Printf("[kv][%d] install snapshot from %d, applied %d -> %d", kv.me, i, kv.applied, reply.Applied)
+        kv.data = reply.Data
+        kv.dups = reply.Dups
+        kv.applied = reply.Applied
+        // the leases granted in the skipped instances are
+        // unknown, so assume every other server holds one
+        if kv.leaseTime > 0 {
+          for h := range kv.servers {
+            if h != kv.me {
+              kv.leases[h] = time.Now().Add(kv.leaseTime)
             }
           }
-          // wait for the same log instance in the next loop
-          seq--
         }
       }
-      kv.applied = uncommitted
+      applied := kv.applied
+      kv.mu.Unlock()
+      kv.px.Done(applied)
+      return
+    }
+    time.Sleep(paxos.LongWait * time.Millisecond)
+  }
+}
+
+func (kv *KVPaxos) Snapshot(args *SnapshotArgs, reply *SnapshotReply) error {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+
+  if kv.applied < args.Seq {
+    reply.Err = ErrBehind
+    return nil
+  }
+
+  reply.Applied = kv.applied
+  reply.Data = make(map[string]string)
+  for k, v := range kv.data {
+    reply.Data[k] = v
+  }
+  reply.Dups = make(map[int64]DupEntry)
+  for k, v := range kv.dups {
+    reply.Dups[k] = v
+  }
+  reply.Err = OK
+  return nil
+}
+
+//
+// Read leases.
+//
+// A server that receives Gets asks for a lease through the
+// log, and renews it while Gets keep coming. Once the lease
+// is applied, the holder serves Get from its applied state
+// until leaseTime after it asked, without a log instance.
+//
+// That is linearizable as long as the holder has applied
+// every op that some server has replied for. So a server
+// that applied an op at seq does not reply before each
+// other server whose lease it knows of has applied seq
+// too, or until that lease has expired. The others count
+// a lease from the time they apply it, which is later than
+// the time the holder counts it from, so a holder cut off
+// by a partition stops serving reads before they go on.
+// leaseTime must be well above the clock drift.
+//
+
+// hold kv.mu before call this func
+func (kv *KVPaxos) ApplyLease(op Op) {
+  holder := int(-1 - op.ClientId)
+  if holder != kv.me {
+    kv.leases[holder] = time.Now().Add(kv.leaseTime)
+    return
+  }
+  if start, ok := kv.leaseStarts[op.Seq]; ok {
+    kv.leaseUntil = start.Add(kv.leaseTime)
+    log.Printf("[kv][%d] lease until %v", kv.me, kv.leaseUntil)
+  }
+  for s := range kv.leaseStarts {
+    if s <= op.Seq {
+      delete(kv.leaseStarts, s)
+    }
+  }
+}
+
+//
+// wait until the servers that may hold a lease have
+// applied seq, or until their leases expire.
+//
+func (kv *KVPaxos) WaitLeases(seq int) {
+  kv.mu.Lock()
+  holders := make(map[int]time.Time)
+  for h, until := range kv.leases {
+    holders[h] = until
+  }
+  kv.mu.Unlock()
+
+  for h, until := range holders {
+    for !kv.dead && time.Now().Before(until) {
+      args := &AppliedArgs{}
+      var reply AppliedReply
+      ok := call(kv.servers[h], "KVPaxos.Applied", args, &reply)
+      if ok && reply.Applied >= seq {
+        break
+      }
+      time.Sleep(paxos.ShortWait * time.Millisecond)
+    }
+  }
+}
+
+func (kv *KVPaxos) Applied(args *AppliedArgs, reply *AppliedReply) error {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+  reply.Applied = kv.applied
+  return nil
+}
+
+//
+// ask for a lease, ahead of time, while Gets keep coming.
+//
+func (kv *KVPaxos) StartLeaseRenewer() {
+  go func() {
+    for !kv.dead {
+      kv.mu.Lock()
+      reading := time.Since(kv.lastRead) < kv.leaseTime
+      expiring := time.Until(kv.leaseUntil) < kv.leaseTime / 2
+      var op Op
+      if reading && expiring {
+        kv.leaseSeq++
+        op = Op{ ClientId: -1 - int64(kv.me), Seq: kv.leaseSeq, OpType: OpLease }
+        kv.leaseStarts[op.Seq] = time.Now()
+      }
+      kv.mu.Unlock()
+
+      if reading && expiring {
+        log.Printf("[kv][%d] ask for a lease, seq %d", kv.me, op.Seq)
+        kv.AppendOp(op)
+      }
+      time.Sleep(kv.leaseTime / 4)
     }
   }()
 }
 
+//
+// serve a Get from the applied state, if this server holds
+// a lease.
+//
+func (kv *KVPaxos) LocalRead(args *GetArgs, reply *GetReply) bool {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+
+  if kv.leaseTime == 0 {
+    return false
+  }
+  kv.lastRead = time.Now()
+  if !time.Now().Before(kv.leaseUntil) {
+    return false
+  }
+  result := kv.DoOp(Op{ OpType: OpRead, Key: args.Key })
+  reply.Err = result.Err
+  reply.Value = result.Value
+  return true
+}
+
 func (kv *KVPaxos) Get(args *GetArgs, reply *GetReply) error {
   log.Printf("[kv][%d] GET request %+v", kv.me, args)
-  seq := kv.AppendOp(args.ReqId, OpRead, args.Key, "")
-  log.Printf("[kv][%d] GET committed %+v, seq %d", kv.me, args, seq)
-  pendingRead := kv.MarkPendingReadCommitted(args.ReqId)
-  val := <- pendingRead.done
-  kv.RemovePendingRead(args.ReqId)
-  if val != nil {
-    reply.Value = *val
-    reply.Err = OK
-  } else {
-    reply.Err = ErrNoKey
+  if kv.LocalRead(args, reply) {
+    return nil
   }
+  result := kv.AppendOp(Op{ args.ClientId, args.Seq, OpRead, args.Key, "", "" })
+  reply.Err = result.Err
+  reply.Value = result.Value
   return nil
 }
 
 func (kv *KVPaxos) Put(args *PutArgs, reply *PutReply) error {
   log.Printf("[kv][%d] PUT request %+v", kv.me, args)
-  seq := kv.AppendOp(args.ReqId, OpWrite, args.Key, args.Value)
-  log.Printf("[kv][%d] GET committed %+v, seq %d", kv.me, args, seq)
-  reply.Err = OK
+  result := kv.AppendOp(Op{ args.ClientId, args.Seq, OpWrite, args.Key, args.Value, "" })
+  reply.Err = result.Err
+  return nil
+}
+
+func (kv *KVPaxos) Append(args *AppendArgs, reply *AppendReply) error {
+  log.Printf("[kv][%d] APPEND request %+v", kv.me, args)
+  result := kv.AppendOp(Op{ args.ClientId, args.Seq, OpAppend, args.Key, args.Value, "" })
+  reply.Err = result.Err
+  return nil
+}
+
+func (kv *KVPaxos) PutHash(args *PutHashArgs, reply *PutHashReply) error {
+  log.Printf("[kv][%d] PUTHASH request %+v", kv.me, args)
+  result := kv.AppendOp(Op{ args.ClientId, args.Seq, OpPutHash, args.Key, args.Value, "" })
+  reply.Err = result.Err
+  reply.PreviousValue = result.Value
+  return nil
+}
+
+func (kv *KVPaxos) CompareAndSwap(args *CompareAndSwapArgs, reply *CompareAndSwapReply) error {
+  log.Printf("[kv][%d] CAS request %+v", kv.me, args)
+  result := kv.AppendOp(Op{ args.ClientId, args.Seq, OpCompareAndSwap, args.Key, args.Value, args.Expected })
+  reply.Err = result.Err
+  reply.Value = result.Value
+  return nil
+}
+
+func (kv *KVPaxos) Delete(args *DeleteArgs, reply *DeleteReply) error {
+  log.Printf("[kv][%d] DELETE request %+v", kv.me, args)
+  result := kv.AppendOp(Op{ args.ClientId, args.Seq, OpDelete, args.Key, "", "" })
+  reply.Err = result.Err
   return nil
 }
 
@@ -267,6 +566,15 @@ func (kv *KVPaxos) kill() {
 // me is the index of the current server in servers[].
 // 
 func StartServer(servers []string, me int) *KVPaxos {
+  return StartLeaseServer(servers, me, 0)
+}
+
+//
+// like StartServer(), but the servers hold read leases of
+// leaseTime; see ApplyLease(). all the servers must use the
+// same leaseTime.
+//
+func StartLeaseServer(servers []string, me int, leaseTime time.Duration) *KVPaxos {
   // this call is all that's needed to persuade
   // Go's RPC library to marshall/unmarshall
   // struct Op.
@@ -274,19 +582,28 @@ func StartServer(servers []string, me int) *KVPaxos {
 
   kv := new(KVPaxos)
   kv.me = me
+  kv.servers = servers
 
   // Your initialization code here.
   kv.data = make(map[string]string)
-  kv.pendingRead = make(map[int64]*PendingRead)
+  kv.waiters = make(map[OpId][]chan Result)
+  kv.dups = make(map[int64]DupEntry)
   kv.applied = -1
+  kv.leaseTime = leaseTime
+  kv.leaseStarts = make(map[int64]time.Time)
+  kv.leases = make(map[int]time.Time)
 
   rpcs := rpc.NewServer()
   rpcs.Register(kv)
 
   kv.px = paxos.Make(servers, me, rpcs)
+  kv.batcher = paxos.MakeBatcher(kv.px, BatchWindow, sameOp)
 
   // start worker
   kv.StartBackgroundWorker()
+  if leaseTime > 0 {
+    kv.StartLeaseRenewer()
+  }
 
   os.Remove(servers[me])
   l, e := net.Listen("unix", servers[me]);
@@ -175,6 +175,238 @@ func TestDone(t *testing.T) {
   fmt.Printf("  ... Passed\n")
 }
 
+//
+// a replica whose state is gone, but whose paxos peer has
+// forgotten the instances it needs, copies a peer's state.
+//
+func TestSnapshot(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("snapshot", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+  var cka [nservers]*Clerk
+  for i := 0; i < nservers; i++ {
+    cka[i] = MakeClerk([]string{kvh[i]})
+  }
+
+  fmt.Printf("Test: Lagging replica installs a snapshot ...\n")
+
+  for i := 0; i < 10; i++ {
+    cka[i % nservers].Put(strconv.Itoa(i), strconv.Itoa(i * 10))
+  }
+  // Put and Get to each of the replicas, so that every
+  // paxos peer hears about the others' Done().
+  for iters := 0; iters < 2; iters++ {
+    for i := 0; i < nservers; i++ {
+      cka[i].Put("a", "aa")
+      check(t, cka[i], "a", "aa")
+    }
+  }
+  time.Sleep(1 * time.Second)
+  if kva[2].px.Min() == 0 {
+    t.Fatalf("paxos did not forget anything")
+  }
+
+  kva[2].mu.Lock()
+  kva[2].data = make(map[string]string)
+  kva[2].dups = make(map[int64]DupEntry)
+  kva[2].applied = -1
+  kva[2].mu.Unlock()
+
+  for i := 0; i < 10; i++ {
+    check(t, cka[2], strconv.Itoa(i), strconv.Itoa(i * 10))
+  }
+  check(t, cka[2], "a", "aa")
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// a retried request gets its original result and is not
+// applied again, and the servers remember one request
+// per clerk.
+//
+func TestDuplicate(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("dup", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+  const nclerks = 4
+  var cka [nclerks]*Clerk
+  for i := 0; i < nclerks; i++ {
+    cka[i] = MakeClerk([]string{kvh[i % nservers]})
+  }
+
+  fmt.Printf("Test: Retried requests are applied once ...\n")
+
+  ck := cka[0]
+  ck.Put("a", "x")
+  // what a retry of that Put would carry
+  args := &PutArgs{ "a", "x", ck.clientId, ck.seq }
+  ck.Put("a", "y")
+  check(t, ck, "a", "y")
+
+  // a retry of the Get right above gets the original
+  // value, even though another clerk wrote since
+  gargs := &GetArgs{ "a", ck.clientId, ck.seq }
+  cka[1].Put("a", "z")
+  var greply GetReply
+  if call(kvh[1], "KVPaxos.Get", gargs, &greply) == false {
+    t.Fatalf("Get retry failed")
+  }
+  if greply.Err != OK || greply.Value != "y" {
+    t.Fatalf("Get retry got %v %v, expected OK y", greply.Err, greply.Value)
+  }
+
+  // a stale Put must not overwrite the newer value
+  var reply PutReply
+  call(kvh[2], "KVPaxos.Put", args, &reply)
+  check(t, cka[1], "a", "z")
+
+  for iters := 0; iters < 20; iters++ {
+    for i := 0; i < nclerks; i++ {
+      cka[i].Put(strconv.Itoa(i), strconv.Itoa(iters))
+    }
+  }
+  for i := 0; i < nclerks; i++ {
+    check(t, cka[(i + 1) % nclerks], strconv.Itoa(i), "19")
+  }
+
+  for i := 0; i < nservers; i++ {
+    kva[i].mu.Lock()
+    n := len(kva[i].dups)
+    kva[i].mu.Unlock()
+    if n > nclerks {
+      t.Fatalf("server %v remembers %v clerks, expected at most %v", i, n, nclerks)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestOps(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("ops", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+  ck := MakeClerk(kvh)
+  var cka [nservers]*Clerk
+  for i := 0; i < nservers; i++ {
+    cka[i] = MakeClerk([]string{kvh[i]})
+  }
+
+  fmt.Printf("Test: Append, PutHash, CompareAndSwap, Delete ...\n")
+
+  ck.Append("a", "x")
+  cka[1].Append("a", "y")
+  check(t, cka[2], "a", "xy")
+
+  prev := ck.PutHash("h", "1")
+  if prev != "" {
+    t.Fatalf("PutHash of a new key returned %v", prev)
+  }
+  prev = cka[2].PutHash("h", "2")
+  if prev != strconv.Itoa(int(hash("1"))) {
+    t.Fatalf("wrong PutHash previous value %v", prev)
+  }
+  check(t, cka[0], "h", strconv.Itoa(int(hash(prev + "2"))))
+
+  ok, v := ck.CompareAndSwap("c", "", "1")
+  if !ok || v != "" {
+    t.Fatalf("CompareAndSwap of a new key failed: %v %v", ok, v)
+  }
+  ok, v = cka[1].CompareAndSwap("c", "0", "2")
+  if ok || v != "1" {
+    t.Fatalf("CompareAndSwap with a wrong value succeeded: %v %v", ok, v)
+  }
+  check(t, cka[2], "c", "1")
+
+  if cka[0].Delete("c") == false {
+    t.Fatalf("Delete of an existing key failed")
+  }
+  if cka[1].Delete("c") {
+    t.Fatalf("Delete of a deleted key succeeded")
+  }
+  check(t, cka[2], "c", "")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Concurrent read-modify-write ...\n")
+
+  const nclients = 3
+  const nincr = 10
+  ck.Put("n", "0")
+  var ca [nclients]chan bool
+  for cli := 0; cli < nclients; cli++ {
+    ca[cli] = make(chan bool)
+    go func(me int) {
+      defer func() { ca[me] <- true }()
+      myck := MakeClerk([]string{kvh[me % nservers]})
+      for i := 0; i < nincr; i++ {
+        myck.Append("q", strconv.Itoa(me))
+        cur := myck.Get("n")
+        for {
+          n, _ := strconv.Atoi(cur)
+          ok, v := myck.CompareAndSwap("n", cur, strconv.Itoa(n + 1))
+          if ok {
+            break
+          }
+          cur = v
+        }
+      }
+    }(cli)
+  }
+  for cli := 0; cli < nclients; cli++ {
+    <- ca[cli]
+  }
+
+  check(t, ck, "n", strconv.Itoa(nclients * nincr))
+  q := ck.Get("q")
+  if len(q) != nclients * nincr {
+    t.Fatalf("appended %v values, expected %v", len(q), nclients * nincr)
+  }
+  for cli := 0; cli < nclients; cli++ {
+    n := 0
+    for _, c := range q {
+      if string(c) == strconv.Itoa(cli) {
+        n++
+      }
+    }
+    if n != nincr {
+      t.Fatalf("client %v appended %v times, expected %v", cli, n, nincr)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
 func pp(tag string, src int, dst int) string {
   s := "/var/tmp/824-"
   s += strconv.Itoa(os.Getuid()) + "/"
@@ -315,6 +547,116 @@ func TestPartition(t *testing.T) {
   fmt.Printf("  ... Passed\n")
 }
 
+func TestLease(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "lease"
+  const nservers = 5
+  const lease = 2 * time.Second
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  defer cleanup(kva)
+  defer cleanpp(tag, nservers)
+
+  for i := 0; i < nservers; i++ {
+    var kvh []string = make([]string, nservers)
+    for j := 0; j < nservers; j++ {
+      if j == i {
+        kvh[j] = port(tag, i)
+      } else {
+        kvh[j] = pp(tag, i, j)
+      }
+    }
+    kva[i] = StartLeaseServer(kvh, i, lease)
+  }
+  defer part(t, tag, nservers, []int{}, []int{}, []int{})
+
+  var cka [nservers]*Clerk
+  for i := 0; i < nservers; i++ {
+    cka[i] = MakeClerk([]string{port(tag, i)})
+  }
+
+  holds := func(kv *KVPaxos) bool {
+    kv.mu.Lock()
+    defer kv.mu.Unlock()
+    return time.Now().Before(kv.leaseUntil)
+  }
+
+  fmt.Printf("Test: Leased reads skip the log ...\n")
+
+  part(t, tag, nservers, []int{0,1,2,3,4}, []int{}, []int{})
+  cka[1].Put("1", "11")
+  for iters := 0; iters < 30 && !holds(kva[0]); iters++ {
+    check(t, cka[0], "1", "11")
+    time.Sleep(100 * time.Millisecond)
+  }
+  if !holds(kva[0]) {
+    t.Fatalf("server 0 did not get a lease")
+  }
+  max := kva[0].px.Max()
+  for i := 0; i < 20; i++ {
+    check(t, cka[0], "1", "11")
+  }
+  // a renewal might have gone in meanwhile
+  if kva[0].px.Max() > max + 1 {
+    t.Fatalf("leased Gets used the log, Max %v -> %v", max, kva[0].px.Max())
+  }
+  // a write elsewhere is visible to the holder at once
+  cka[2].Put("1", "12")
+  check(t, cka[0], "1", "12")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Writes wait out a partitioned lease holder ...\n")
+
+  part(t, tag, nservers, []int{1,2,3,4}, []int{0}, []int{})
+  done := false
+  go func() {
+    cka[1].Put("1", "13")
+    done = true
+  }()
+  time.Sleep(200 * time.Millisecond)
+  if done {
+    t.Fatalf("Put completed while the holder had a lease")
+  }
+  // the Put has not completed, so the old value is fine
+  check(t, cka[0], "1", "12")
+  for iters := 0; iters < 40 && !done; iters++ {
+    time.Sleep(100 * time.Millisecond)
+  }
+  if !done {
+    t.Fatalf("Put did not complete after the lease expired")
+  }
+  if holds(kva[0]) {
+    t.Fatalf("server 0 still holds a lease")
+  }
+  check(t, cka[4], "1", "13")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: No leased reads after the lease expired ...\n")
+
+  done0 := false
+  go func() {
+    cka[0].Get("1")
+    done0 = true
+  }()
+  time.Sleep(time.Second)
+  if done0 {
+    t.Fatalf("Get at a partitioned server completed")
+  }
+
+  part(t, tag, nservers, []int{0,1,2,3,4}, []int{}, []int{})
+  for iters := 0; iters < 50 && !done0; iters++ {
+    time.Sleep(100 * time.Millisecond)
+  }
+  if !done0 {
+    t.Fatalf("Get did not complete after heal")
+  }
+  check(t, cka[0], "1", "13")
+
+  fmt.Printf("  ... Passed\n")
+}
+
 func TestUnreliable(t *testing.T) {
   runtime.GOMAXPROCS(4)
 
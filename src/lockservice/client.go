@@ -60,10 +60,21 @@ func call(srv string, rpcname string,
 // you will have to modify this function.
 //
 func (ck *Clerk) Lock(lockname string) bool {
+	ok, _, _ := ck.LockLease(lockname, DefaultLease)
+	return ok
+}
+
+//
+// ask the lock service for a lock, held for lease unless
+// renewed. returns true, the lease and the fencing token
+// if the lock service granted the lock, false otherwise.
+//
+func (ck *Clerk) LockLease(lockname string, lease time.Duration) (bool, int64, uint64) {
 	// prepare the arguments.
 	args := &LockArgs{}
 	args.Lockname = lockname
 	args.Lockid = time.Now().UnixNano()
+	args.Lease = lease
 	var reply LockReply
 
 	// send an RPC request, wait for the reply.
@@ -76,9 +87,30 @@ func (ck *Clerk) Lock(lockname string) bool {
 	}
 
 	if !ok {
-		return false
+		return false, 0, 0
 	}
 
+	return reply.OK, reply.Lease, reply.Token
+}
+
+//
+// ask the lock service to hold a lock that lease holds for
+// another d from now. returns false if the lease has run out.
+//
+func (ck *Clerk) Renew(lockname string, lease int64, d time.Duration) bool {
+	args := &RenewArgs{}
+	args.Lockname = lockname
+	args.Lease = lease
+	args.Duration = d
+	var reply RenewReply
+
+	ok := call(ck.servers[0], "LockServer.Renew", args, &reply)
+	if !ok {
+		ok = call(ck.servers[1], "LockServer.Renew", args, &reply)
+	}
+	if !ok {
+		return false
+	}
 	return reply.OK
 }
 
@@ -89,9 +121,19 @@ func (ck *Clerk) Lock(lockname string) bool {
 //
 
 func (ck *Clerk) Unlock(lockname string) bool {
+	return ck.UnlockLease(lockname, 0)
+}
+
+//
+// like Unlock(), but lets go of the lock only if lease still
+// holds it; returns false, and leaves the lock alone, if the
+// lease has run out, even if someone else holds the lock now.
+//
+func (ck *Clerk) UnlockLease(lockname string, lease int64) bool {
 	args := &UnlockArgs{}
 	args.Lockname = lockname
 	args.Lockid = time.Now().UnixNano()
+	args.Lease = lease
 	var reply UnlockReply
 
   // fmt.Println("0 Unlock", args)
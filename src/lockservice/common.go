@@ -6,30 +6,75 @@ package lockservice
 // You will need to modify this file.
 //
 
+import "time"
+
+//
+// A lock is held for a lease, which the holder renews
+// before it runs out; each server lets the lock go when the
+// lease has run out by its own clock.
+//
+// how long a lock is held if the Lock asks for no lease
+const DefaultLease = 10 * time.Second
+
 //
 // Lock(lockname) returns OK=true if the lock is not held.
 // If it is held, it returns OK=false immediately.
+// the lease is named by the Lockid of the Lock that got it.
 //
 type LockArgs struct {
 	// Go's net/rpc requires that these field
 	// names start with upper case letters!
 	Lockname  string // lock name
 	Lockid int64
+	Lease time.Duration // 0 for DefaultLease
+	// set when the primary forwards the Lock to the backup,
+	// with whether it granted the lock and the token
+	Forwarded bool
+	Granted bool
+	Token uint64
 }
 
 type LockReply struct {
 	OK bool
+	Lease int64 // if OK, names the lease for Renew
+	// if OK, the fencing token: higher than any token given
+	// out for lockname before; see fence.go
+	Token uint64
 }
 
 //
 // Unlock(lockname) returns OK=true if the lock was held.
 // It returns OK=false if the lock was not held.
+// with a Lease, only that lease's hold on the lock counts:
+// once the lock has passed to another, it is left alone.
 //
 type UnlockArgs struct {
 	Lockname  string
 	Lockid int64
+	Lease int64 // 0 for whoever holds the lock
+	// set when the primary forwards the Unlock to the backup,
+	// with whether the lock was held
+	Forwarded bool
+	Held bool
 }
 
 type UnlockReply struct {
 	OK bool
 }
+
+//
+// Renew(lockname, lease) returns OK=true, and holds the
+// lock for another Duration from now, if lease still holds
+// it. It returns OK=false if the lease has run out.
+//
+type RenewArgs struct {
+	Lockname string
+	Lease int64
+	Duration time.Duration // 0 for DefaultLease
+	// set when the primary forwards the Renew to the backup
+	Forwarded bool
+}
+
+type RenewReply struct {
+	OK bool
+}
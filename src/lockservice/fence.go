@@ -0,0 +1,53 @@
+package lockservice
+
+//
+// Fencing tokens, for the services that lock holders write to.
+//
+// Each time the lock service grants a lock it gives out a
+// token one higher than the last one for that lock name, and
+// the backup gives out the same tokens as the primary. A
+// holder sends its token along with each write to a storage
+// service, which keeps a Fence and turns away a write whose
+// token is lower than the highest it has seen for the lock:
+// that write comes from a holder that has lost the lock since,
+// even if the holder does not know it yet (say, it was paused
+// while its lease ran out).
+//
+
+import "sync"
+
+type Fence struct {
+	mu      sync.Mutex
+	highest map[string]uint64 // by lock name
+}
+
+func MakeFence() *Fence {
+	f := new(Fence)
+	f.highest = make(map[string]uint64)
+	return f
+}
+
+//
+// may a write under lockname carrying token go ahead? it may
+// if no higher token has been seen for lockname; token is
+// then the highest.
+//
+func (f *Fence) Check(lockname string, token uint64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if token < f.highest[lockname] {
+		return false
+	}
+	f.highest[lockname] = token
+	return true
+}
+
+//
+// the highest token seen for lockname, 0 if none.
+//
+func (f *Fence) Highest(lockname string) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.highest[lockname]
+}
@@ -14,6 +14,14 @@ type OpKey struct {
 	Lockid   int64
 }
 
+// the holder of a lock, its fencing token, and when its
+// lease runs out by this server's clock
+type lease struct {
+	id      int64
+	token   uint64
+	expires time.Time
+}
+
 type LockServer struct {
 	mu    sync.Mutex
 	l     net.Listener
@@ -23,9 +31,13 @@ type LockServer struct {
 	am_primary bool   // am I the primary?
 	backup     string // backup's port
 
-	// for each lock name, is it locked?
-	locks      map[string]bool
+	// for each lock name that is locked, its lease
+	locks      map[string]lease
 	operations map[OpKey]bool
+	// for each lock name, the latest fencing token given out,
+	// and the token of each Lock that was granted
+	tokens map[string]uint64
+	grants map[OpKey]uint64
 }
 
 //
@@ -116,19 +128,37 @@ func (ls *LockServer) Lock(args *LockArgs, reply *LockReply) error {
 	res, ok := ls.operations[key]
 	if ok {
 		reply.OK = res
+		if res {
+			reply.Lease = args.Lockid
+			reply.Token = ls.grants[key]
+		}
 		return nil
 	}
 
 	/*	fmt.Println(ls.locks)
 		fmt.Println(ls.operations)*/
-	locked := ls.locks[args.Lockname]
+	locked := ls.held(args.Lockname)
+	if args.Forwarded {
+		// the primary decided, by its clock
+		locked = !args.Granted
+	}
 	if locked {
 		reply.OK = false
 	} else {
 		reply.OK = true
-		ls.locks[args.Lockname] = true
+		reply.Lease = args.Lockid
+		reply.Token = ls.tokens[args.Lockname] + 1
+		if args.Forwarded {
+			reply.Token = args.Token
+		}
+		ls.tokens[args.Lockname] = reply.Token
+		ls.grants[key] = reply.Token
+		ls.locks[args.Lockname] = lease{args.Lockid, reply.Token, expiry(args.Lease)}
 	}
 	if ls.am_primary {
+		args.Forwarded = true
+		args.Granted = reply.OK
+		args.Token = reply.Token
 		var re LockReply
 		ok := call(ls.backup, "LockServer.Lock", args, &re)
 		if !ok {
@@ -156,14 +186,17 @@ func (ls *LockServer) Unlock(args *UnlockArgs, reply *UnlockReply) error {
 
 	/*	fmt.Println(ls.locks)
 		fmt.Println(ls.operations)*/
-	locked := ls.locks[args.Lockname]
-	if locked {
-		reply.OK = true
-		ls.locks[args.Lockname] = false
-	} else {
-		reply.OK = false
+	locked := ls.held(args.Lockname) && ls.holds(args.Lockname, args.Lease)
+	if args.Forwarded {
+		locked = args.Held
+	}
+	reply.OK = locked
+	if ls.holds(args.Lockname, args.Lease) {
+		delete(ls.locks, args.Lockname)
 	}
 	if ls.am_primary {
+		args.Forwarded = true
+		args.Held = reply.OK
 		var re LockReply
 		ok := call(ls.backup, "LockServer.Unlock", args, &re)
 		if !ok {
@@ -175,6 +208,69 @@ func (ls *LockServer) Unlock(args *UnlockArgs, reply *UnlockReply) error {
 	return nil
 }
 
+//
+// server Renew RPC handler.
+//
+func (ls *LockServer) Renew(args *RenewArgs, reply *RenewReply) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if !args.Forwarded {
+		if !ls.held(args.Lockname) || ls.locks[args.Lockname].id != args.Lease {
+			reply.OK = false
+			return nil
+		}
+	}
+	// a Renew the primary forwards holds even if the lease
+	// ran out by this server's clock
+	token := ls.tokens[args.Lockname]
+	if l, ok := ls.locks[args.Lockname]; ok && l.id == args.Lease {
+		token = l.token
+	}
+	ls.locks[args.Lockname] = lease{args.Lease, token, expiry(args.Duration)}
+	reply.OK = true
+	if ls.am_primary {
+		args.Forwarded = true
+		var re RenewReply
+		ok := call(ls.backup, "LockServer.Renew", args, &re)
+		if !ok {
+			fmt.Println("Cannot call backup:", args)
+		}
+	}
+	return nil
+}
+
+//
+// is lockname locked? a lock whose lease has run out is
+// let go.
+// hold ls.mu before call this func
+//
+func (ls *LockServer) held(lockname string) bool {
+	l, ok := ls.locks[lockname]
+	if ok && time.Now().After(l.expires) {
+		delete(ls.locks, lockname)
+		return false
+	}
+	return ok
+}
+
+//
+// is lockname's lock, if any, held by lease? any lease
+// will do if lease is 0.
+// hold ls.mu before call this func
+//
+func (ls *LockServer) holds(lockname string, lease int64) bool {
+	return lease == 0 || ls.locks[lockname].id == lease
+}
+
+// when a lease of duration d from now runs out.
+func expiry(d time.Duration) time.Time {
+	if d <= 0 {
+		d = DefaultLease
+	}
+	return time.Now().Add(d)
+}
+
 //
 // tell the server to shut itself down.
 // for testing.
@@ -210,7 +306,9 @@ func StartServer(primary string, backup string, am_primary bool) *LockServer {
 	ls := new(LockServer)
 	ls.backup = backup
 	ls.am_primary = am_primary
-	ls.locks = make(map[string]bool)
+	ls.locks = make(map[string]lease)
+	ls.tokens = make(map[string]uint64)
+	ls.grants = make(map[OpKey]uint64)
 	ls.operations = make(map[OpKey]bool)
 
 	// Your initialization code here.
@@ -476,3 +476,144 @@ func TestConcurrentCounts(t *testing.T) {
   b.kill()
   fmt.Printf("  ... Passed\n")
 }
+
+func TestLease(t *testing.T) {
+  fmt.Printf("Test: Lock is let go when its lease runs out ...\n")
+  runtime.GOMAXPROCS(4)
+
+  phost := port("p")
+  bhost := port("b")
+  p := StartServer(phost, bhost, true)  // primary
+  b := StartServer(phost, bhost, false) // backup
+
+  ck1 := MakeClerk(phost, bhost)
+  ck2 := MakeClerk(phost, bhost)
+
+  lease := 300 * time.Millisecond
+  ok, _, _ := ck1.LockLease("a", lease)
+  if !ok {
+    t.Fatalf("LockLease(a) returned false")
+  }
+  tl(t, ck2, "a", false)
+  time.Sleep(2 * lease)
+  tl(t, ck2, "a", true)
+  tu(t, ck2, "a", true)
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Renewed lease keeps the lock ...\n")
+
+  ok, l, _ := ck1.LockLease("b", lease)
+  if !ok {
+    t.Fatalf("LockLease(b) returned false")
+  }
+  for i := 0; i < 10; i++ {
+    time.Sleep(lease / 3)
+    if !ck1.Renew("b", l, lease) {
+      t.Fatalf("Renew(b) returned false")
+    }
+    tl(t, ck2, "b", false)
+  }
+  time.Sleep(2 * lease)
+  if ck1.Renew("b", l, lease) {
+    t.Fatalf("Renew(b) after the lease ran out returned true")
+  }
+  tl(t, ck2, "b", true)
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Unlock of a lease that ran out leaves the lock alone ...\n")
+
+  ok, l, _ = ck1.LockLease("d", lease)
+  if !ok {
+    t.Fatalf("LockLease(d) returned false")
+  }
+  time.Sleep(2 * lease)
+  ok, l2, _ := ck2.LockLease("d", 0)
+  if !ok {
+    t.Fatalf("LockLease(d) after the lease ran out returned false")
+  }
+  if ck1.UnlockLease("d", l) {
+    t.Fatalf("UnlockLease(d) after the lease ran out returned true")
+  }
+  tl(t, ck1, "d", false)
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Backup lets go of a lock after primary failure ...\n")
+
+  ok, l, _ = ck1.LockLease("c", lease)
+  if !ok {
+    t.Fatalf("LockLease(c) returned false")
+  }
+  time.Sleep(lease / 3)
+  if !ck1.Renew("c", l, lease) {
+    t.Fatalf("Renew(c) returned false")
+  }
+  p.kill()
+  tl(t, ck2, "c", false)
+  // the backup did not let go of d either
+  tl(t, ck1, "d", false)
+  if !ck2.UnlockLease("d", l2) {
+    t.Fatalf("UnlockLease(d) at the backup returned false")
+  }
+  if !ck1.Renew("c", l, lease) {
+    t.Fatalf("Renew(c) at the backup returned false")
+  }
+  tl(t, ck2, "c", false)
+  time.Sleep(2 * lease)
+  tl(t, ck2, "c", true)
+  fmt.Printf("  ... Passed\n")
+
+  b.kill()
+}
+
+func TestFencing(t *testing.T) {
+  fmt.Printf("Test: Fencing tokens go up, across primary failure ...\n")
+  runtime.GOMAXPROCS(4)
+
+  phost := port("p")
+  bhost := port("b")
+  p := StartServer(phost, bhost, true)  // primary
+  b := StartServer(phost, bhost, false) // backup
+
+  ck1 := MakeClerk(phost, bhost)
+  ck2 := MakeClerk(phost, bhost)
+  fence := MakeFence()
+
+  lease := 300 * time.Millisecond
+  ok, _, t1 := ck1.LockLease("a", lease)
+  if !ok || !fence.Check("a", t1) {
+    t.Fatalf("first holder fenced off")
+  }
+
+  // ck1 stalls; its lease runs out and ck2 gets the lock
+  time.Sleep(2 * lease)
+  ok, _, t2 := ck2.LockLease("a", lease)
+  if !ok || t2 <= t1 {
+    t.Fatalf("second token %v not above first %v", t2, t1)
+  }
+  if !fence.Check("a", t2) {
+    t.Fatalf("second holder fenced off")
+  }
+  if fence.Check("a", t1) {
+    t.Fatalf("stale token %v accepted after %v", t1, t2)
+  }
+  tu(t, ck2, "a", true)
+
+  // another lock has its own tokens
+  ok, _, tb := ck1.LockLease("b", lease)
+  if !ok || tb != 1 || !fence.Check("b", tb) {
+    t.Fatalf("token for b is %v, expected 1", tb)
+  }
+
+  // the backup goes on from the primary's tokens
+  p.kill()
+  ok, _, t3 := ck1.LockLease("a", lease)
+  if !ok || t3 <= t2 {
+    t.Fatalf("token %v from the backup not above %v", t3, t2)
+  }
+  if !fence.Check("a", t3) || fence.Check("a", t2) {
+    t.Fatalf("fence did not move on to %v", t3)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  b.kill()
+}
@@ -8,14 +8,15 @@ import "time"
 import "pbservice"
 import "os"
 import "fmt"
+import "strings"
 
 func main() {
   if len(os.Args) != 3 {
-    fmt.Printf("Usage: pbd viewport myport\n")
+    fmt.Printf("Usage: pbd viewport[,viewport...] myport\n")
     os.Exit(1)
   }
 
-  pbservice.StartServer(os.Args[1], os.Args[2])
+  pbservice.StartServerVS(strings.Split(os.Args[1], ","), os.Args[2])
 
   for { time.Sleep(100 * time.Second) }
 }
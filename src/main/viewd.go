@@ -3,19 +3,38 @@ package main
 //
 // see directions in pbc.go
 //
+// to run a replicated view service, start one viewd
+// per replica, each with its index in the list of all
+// of their ports:
+//
+// ./viewd 0 /tmp/rtm-v0 /tmp/rtm-v1 /tmp/rtm-v2 &
+// ./viewd 1 /tmp/rtm-v0 /tmp/rtm-v1 /tmp/rtm-v2 &
+// ./viewd 2 /tmp/rtm-v0 /tmp/rtm-v1 /tmp/rtm-v2 &
+//
+// and give pbd and pbc the ports joined by commas.
+//
 
 import "time"
 import "viewservice"
 import "os"
 import "fmt"
+import "strconv"
 
 func main() {
-  if len(os.Args) != 2 {
+  if len(os.Args) == 2 {
+    viewservice.StartServer(os.Args[1])
+  } else if len(os.Args) > 3 {
+    me, err := strconv.Atoi(os.Args[1])
+    if err != nil || me < 0 || me >= len(os.Args) - 2 {
+      fmt.Printf("viewd: bad index %v\n", os.Args[1])
+      os.Exit(1)
+    }
+    viewservice.StartReplica(os.Args[2:], me, viewservice.DefaultBackups)
+  } else {
     fmt.Printf("Usage: viewd port\n")
+    fmt.Printf("       viewd me port0 port1 ...\n")
     os.Exit(1)
   }
 
-  viewservice.StartServer(os.Args[1])
-
   for { time.Sleep(100 * time.Second) }
 }
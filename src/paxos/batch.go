@@ -0,0 +1,155 @@
+package paxos
+
+//
+// Batched proposals, for applications that use Paxos as a log.
+//
+// Submit() gathers the values handed to it for a short
+// window and proposes them together, as one Batch, at the
+// next instance this peer has not seen used (or, if this
+// peer lags Alpha or more behind, at the first instance it
+// has not learned). When another value wins that instance,
+// the values that did not make it are proposed again at a
+// later instance, together with the ones submitted in the
+// meantime.
+//
+// The application applies a decided Batch by applying its
+// Values in order, and may find the same value in more than
+// one Batch (e.g. after a client retried at another peer).
+//
+
+import "sync"
+import "time"
+import "log"
+import "encoding/gob"
+
+type Batch struct {
+  Values []interface{}
+}
+
+type batchItem struct {
+  v interface{}
+  done chan int
+}
+
+type Batcher struct {
+  mu sync.Mutex
+  px *Paxos
+  window time.Duration
+  // whether two values are the same request
+  same func(a interface{}, b interface{}) bool
+  pending []*batchItem
+  running bool
+}
+
+func init() {
+  gob.Register(Batch{})
+}
+
+func MakeBatcher(px *Paxos, window time.Duration,
+                 same func(a interface{}, b interface{}) bool) *Batcher {
+  b := &Batcher{}
+  b.px = px
+  b.window = window
+  b.same = same
+  return b
+}
+
+//
+// propose v and wait until it is decided. returns the
+// instance whose Batch holds v, or -1 if the peer died.
+//
+func (b *Batcher) Submit(v interface{}) int {
+  item := &batchItem{ v, make(chan int, 1) }
+  b.mu.Lock()
+  b.pending = append(b.pending, item)
+  if !b.running {
+    b.running = true
+    go b.run()
+  }
+  b.mu.Unlock()
+  return <- item.done
+}
+
+func (b *Batcher) run() {
+  var items []*batchItem
+  for !b.px.dead {
+    time.Sleep(b.window)
+
+    b.mu.Lock()
+    items = append(items, b.pending...)
+    b.pending = nil
+    if len(items) == 0 {
+      b.running = false
+      b.mu.Unlock()
+      return
+    }
+    b.mu.Unlock()
+
+    values := make([]interface{}, len(items))
+    for i, item := range items {
+      values[i] = item.v
+    }
+    seq := b.px.Max() + 1
+    if first := b.px.DecidedUpTo() + 1; seq - Alpha >= first {
+      // the members for seq are not known until every
+      // instance <= seq - Alpha is decided (see membership.go).
+      // propose at the first gap instead, which also learns
+      // its decision if there is one.
+      seq = first
+    }
+    log.Printf("[px][%d] batch: propose %d values at seq %d", b.px.me, len(values), seq)
+    b.px.Start(seq, Batch{ values })
+
+    decided, v := b.Wait(seq)
+    if !decided {
+      break
+    }
+    batch, _ := v.(Batch)
+    var left []*batchItem
+    for _, item := range items {
+      if b.contains(batch, item.v) {
+        item.done <- seq
+      } else {
+        left = append(left, item)
+      }
+    }
+    items = left
+  }
+
+  // dead
+  b.mu.Lock()
+  items = append(items, b.pending...)
+  b.pending = nil
+  b.running = false
+  b.mu.Unlock()
+  for _, item := range items {
+    item.done <- -1
+  }
+}
+
+func (b *Batcher) contains(batch Batch, v interface{}) bool {
+  for _, x := range batch.Values {
+    if b.same(x, v) {
+      return true
+    }
+  }
+  return false
+}
+
+//
+// wait for seq to be decided; false if the peer died first.
+//
+func (b *Batcher) Wait(seq int) (bool, interface{}) {
+  sleep := ShortWait * time.Millisecond
+  for !b.px.dead {
+    decided, v := b.px.Status(seq)
+    if decided {
+      return true, v
+    }
+    time.Sleep(sleep)
+    if sleep < LongWait * time.Millisecond {
+      sleep *= 2
+    }
+  }
+  return false, nil
+}
@@ -0,0 +1,157 @@
+package paxos
+
+//
+// Dynamic membership.
+//
+// A peer is named by its index into peers[], for life: a
+// peer that is removed keeps its index, and a peer that is
+// added gets a new one. The members of the group change
+// through the log itself: once a Reconfig value is decided
+// at instance seq, its peers are the members for every
+// instance >= seq + Alpha. Instances below that keep using
+// the old members.
+//
+// The application must not Start(seq) before it has learned
+// the decisions of all instances <= seq - Alpha, otherwise
+// it might propose with members that are no longer current.
+//
+// A peer added by a Reconfig decided at seq is made with
+// MakeJoining(peers, me, rpcs, dir, seq + Alpha); it takes
+// part in instances >= seq + Alpha only.
+//
+
+import "log"
+import "sort"
+import "encoding/gob"
+
+const Alpha = 10
+
+//
+// Peers[i] is the address of peer i, or "" if peer i is not
+// a member. peers that are already known keep the address
+// they have locally; new ones are appended.
+//
+type Reconfig struct {
+  Peers []string
+}
+
+type membership struct {
+  From int
+  Members []int
+}
+
+func init() {
+  gob.Register(Reconfig{})
+}
+
+func membersOf(peers []string) []int {
+  var members []int
+  for i, p := range peers {
+    if p != "" {
+      members = append(members, i)
+    }
+  }
+  return members
+}
+
+//
+// the ids and addresses of the members for seq.
+//
+func (px *Paxos) MembersFor(seq int) ([]int, []string) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  c := px.ConfigFor(seq)
+  addrs := make([]string, len(c.Members))
+  for i, id := range c.Members {
+    addrs[i] = px.peers[id]
+  }
+  return c.Members, addrs
+}
+
+// hold px.mu before call this func
+func (px *Paxos) ConfigFor(seq int) *membership {
+  for i := len(px.configs) - 1; i > 0; i-- {
+    if px.configs[i].From <= seq {
+      return &px.configs[i]
+    }
+  }
+  return &px.configs[0]
+}
+
+//
+// the highest seq such that this peer has learned the
+// decisions of all instances <= seq; forgotten instances
+// count as decided. Start(seq) is safe for any
+// seq <= DecidedUpTo() + Alpha.
+//
+func (px *Paxos) DecidedUpTo() int {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  if px.decidedTo < px.minSeq - 1 {
+    px.decidedTo = px.minSeq - 1
+  }
+  for {
+    entry, ok := px.logInstances[px.decidedTo + 1]
+    if !ok || entry.status != Decided {
+      break
+    }
+    px.decidedTo++
+  }
+  return px.decidedTo
+}
+
+//
+// a Reconfig was decided at seq.
+// hold px.mu before call this func
+//
+func (px *Paxos) ApplyReconfig(seq int, r Reconfig) {
+  from := seq + Alpha
+  for _, c := range px.configs {
+    if c.From == from {
+      return
+    }
+  }
+
+  for i := len(px.peers); i < len(r.Peers); i++ {
+    px.peers = append(px.peers, r.Peers[i])
+  }
+  px.configs = append(px.configs, membership{ from, membersOf(r.Peers) })
+  sort.Slice(px.configs, func(i, j int) bool {
+    return px.configs[i].From < px.configs[j].From
+  })
+  px.PersistState()
+
+  log.Printf("[px][%d] reconfig at seq %d: members %v from seq %d", px.me, seq, membersOf(r.Peers), from)
+}
+
+func (c *membership) IsMember(id int) bool {
+  for _, m := range c.Members {
+    if m == id {
+      return true
+    }
+  }
+  return false
+}
+
+//
+// the first instance peer id is known to be a member for.
+// hold px.mu before call this func
+//
+func (px *Paxos) JoinedAt(id int) int {
+  for i := range px.configs {
+    if px.configs[i].IsMember(id) {
+      return px.configs[i].From
+    }
+  }
+  return 0
+}
+
+//
+// forget the configurations that no instance >= minSeq uses.
+// hold px.mu before call this func
+//
+func (px *Paxos) ForgetConfigs() {
+  for len(px.configs) > 1 && px.configs[1].From <= px.minSeq {
+    px.configs = px.configs[1:]
+  }
+}
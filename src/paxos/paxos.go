@@ -6,13 +6,26 @@ package paxos
 // a Paxos peer.
 //
 // Manages a sequence of agreed-on values.
-// The set of peers is fixed.
+// The set of peers changes only through Reconfig values
+// agreed on in the log (see membership.go).
 // Copes with network failures (partition, msg loss, &c).
-// Does not store anything persistently, so cannot handle crash+restart.
+// Peers made with Make() do not store anything persistently,
+// so cannot handle crash+restart. Peers made with
+// MakePersistent() keep acceptor state in a directory on
+// disk (see storage.go) and can be restarted with it.
+//
+// In steady state one peer acts as leader: it prepares all
+// instances from some seq on with a single PrepareAll round,
+// and then proposes new instances with Accept RPCs only.
+// Other peers forward their proposals to the leader, and
+// fall back to the full prepare/accept protocol when the
+// leader seems dead or its proposal number is superseded.
 //
 // The application interface:
 //
 // px = paxos.Make(peers []string, me string)
+// px = paxos.MakePersistent(peers []string, me string, dir string)
+// px = paxos.MakeJoining(peers []string, me string, dir string, from int)
 // px.Start(seq int, v interface{}) -- start agreement on new instance
 // px.Status(seq int) (decided bool, v interface{}) -- get info about an instance
 // px.Done(seq int) -- ok to forget all instances <= seq
@@ -58,6 +71,8 @@ type Paxos struct {
   rpcCount int
   peers []string
   me int // index into peers[]
+  // members of the group, ordered by From
+  configs []membership
 
   // Your data here.
   logSeqs []int
@@ -66,8 +81,32 @@ type Paxos struct {
   maxSeq int
   minSeq int
   doneSeq int
+  // all instances <= decidedTo are decided here
+  decidedTo int
   maxPrepareSeen int
   maxPrepareOwner int
+
+  // durable acceptor state, nil if dir is ""
+  dir string
+  storage *os.File
+  // records in storage, live or not
+  storageRecords int
+
+  // acceptor: promised to reject n < prepareAllN
+  // for every instance >= prepareAllFrom
+  prepareAllN int
+  prepareAllFrom int
+  // who leads, as seen by this peer
+  leader int
+  leaderTime time.Time
+
+  // proposer: instances >= leaderFrom may skip
+  // the prepare phase and use leaderN
+  isLeader bool
+  leaderN int
+  leaderFrom int
+  // values accepted by others before we became leader
+  leaderValues map[int]interface{}
 }
 
 //
@@ -112,23 +151,90 @@ func callWithRetry(srv string, name string, args interface{}, reply interface{},
   return false
 }
 
+//
+// like callWithRetry(), but a peer's calls to itself go
+// straight to its handlers, so that it still hears its own
+// proposals when others cannot reach it (e.g. its socket
+// was removed). don't hold px.mu.
+//
+func (px *Paxos) callPeer(id int, srv string, name string, args interface{}, reply interface{}, maxRetries int) bool {
+  if id != px.me {
+    return callWithRetry(srv, name, args, reply, maxRetries)
+  }
+  var err error
+  switch name {
+  case "Paxos.HandlePrepare":
+    err = px.HandlePrepare(args.(*PrepareArgs), reply.(*PrepareReply))
+  case "Paxos.HandlePrepareAll":
+    err = px.HandlePrepareAll(args.(*PrepareAllArgs), reply.(*PrepareAllReply))
+  case "Paxos.HandleAccept":
+    err = px.HandleAccept(args.(*AcceptArgs), reply.(*AcceptReply))
+  case "Paxos.HandleDecided":
+    err = px.HandleDecided(args.(*DecidedArgs), reply.(*DecidedReply))
+  default:
+    return callWithRetry(srv, name, args, reply, maxRetries)
+  }
+  return err == nil
+}
+
 // hold px.mu before call this func
 func (px *Paxos) UpdatePeerSeq(peer int, seq int, done int) {
   if px.maxSeq < seq { px.maxSeq = seq }
 
   px.peerDoneSeqs[peer] = done
-  if len(px.peerDoneSeqs) < len(px.peers) {
-    return
-  }
+  px.ForgetBelow(px.GlobalMinDone() + 1)
+}
 
+//
+// the lowest Done() argument over the members of the
+// configuration in effect at px.maxSeq and of the ones
+// decided to follow it, or -1 if this peer has not heard
+// from all of them. until a new configuration takes
+// effect the old members still decide instances, so they
+// count too. a member is only held to the instances of the
+// configurations it is in; one that joined at seq is done
+// with everything below seq. a peer that was a member of
+// the first configuration this peer knows of may still need
+// what came before it.
+// hold px.mu before call this func
+//
+func (px *Paxos) GlobalMinDone() int {
   minDoneSeq := px.doneSeq
-  for _, n := range px.peerDoneSeqs {
-    if minDoneSeq > n { minDoneSeq = n }
+  for i := range px.configs {
+    if i + 1 < len(px.configs) && px.configs[i + 1].From <= px.maxSeq {
+      // superseded
+      continue
+    }
+    end := -1
+    if i + 1 < len(px.configs) {
+      end = px.configs[i + 1].From - 1
+    }
+    for _, id := range px.configs[i].Members {
+      n, ok := px.peerDoneSeqs[id]
+      if id == px.me {
+        n, ok = px.doneSeq, true
+      }
+      if !ok {
+        n = -1
+        if at := px.JoinedAt(id); at > px.configs[0].From {
+          n = at - 1
+        }
+      }
+      if end >= 0 && n >= end {
+        // done with all of this configuration's instances
+        continue
+      }
+      if minDoneSeq > n { minDoneSeq = n }
+    }
   }
+  return minDoneSeq
+}
 
-  if minDoneSeq + 1 > px.minSeq {
-    log.Printf("[px][%d] update peer seq: new min seq %d, old min seq %d", px.me, minDoneSeq + 1, px.minSeq)
-    px.minSeq = minDoneSeq + 1
+// hold px.mu before call this func
+func (px *Paxos) ForgetBelow(minSeq int) {
+  if minSeq > px.minSeq {
+    log.Printf("[px][%d] update peer seq: new min seq %d, old min seq %d", px.me, minSeq, px.minSeq)
+    px.minSeq = minSeq
     var activeSeqs []int
     log.Printf("[px][%d] update peer seq: num of logs %d", px.me, len(px.logSeqs))
     for _, s := range px.logSeqs {
@@ -140,7 +246,22 @@ func (px *Paxos) UpdatePeerSeq(peer int, seq int, done int) {
       }
     }
     px.logSeqs = activeSeqs
+    px.ForgetConfigs()
+    px.CompactStorage()
+  }
+}
+
+//
+// the highest number the acceptor promised for entry,
+// either by its own prepare or by a leader's PrepareAll.
+// hold px.mu before call this func
+//
+func (px *Paxos) PromisedNumber(entry *LogInstance) int {
+  np := entry.np
+  if entry.seq >= px.prepareAllFrom && px.prepareAllN > np {
+    np = px.prepareAllN
   }
+  return np
 }
 
 func (px *Paxos) HandleDecided(args *DecidedArgs, reply *DecidedReply) error {
@@ -148,6 +269,9 @@ func (px *Paxos) HandleDecided(args *DecidedArgs, reply *DecidedReply) error {
   defer px.mu.Unlock()
 
   px.UpdatePeerSeq(args.Peer, args.Seq, args.DoneSeq)
+  // followers only hear from the leader, so the leader
+  // passes on what it knows about everybody's Done()
+  px.ForgetBelow(args.MinDone + 1)
 
   if args.Seq < px.minSeq {
     log.Printf("[px][%d] ignore decided, seq %d < min seq %d", px.me, args.Seq, px.minSeq)
@@ -174,6 +298,10 @@ func (px *Paxos) HandleDecided(args *DecidedArgs, reply *DecidedReply) error {
     entry.va = args.V
     entry.status = Decided
   }
+  px.PersistInstance(entry)
+  if r, ok := args.V.(Reconfig); ok {
+    px.ApplyReconfig(args.Seq, r)
+  }
 
   log.Printf("[px][%d] handle decided: args %+v entry %+v\n", px.me, args, entry)
 
@@ -209,22 +337,83 @@ func (px *Paxos) HandlePrepare(args *PrepareArgs, reply *PrepareReply) error {
 
   log.Printf("[px][%d] handle prepare: args %+v entry %+v\n", px.me, args, entry)
 
-  if args.N > entry.np {
+  if args.N > px.PromisedNumber(entry) {
     entry.who = args.Peer
     entry.np = args.N
+    // must be on disk before the promise is sent
+    px.PersistInstance(entry)
     reply.Seq = args.Seq
     reply.Na = entry.na
     reply.Va = entry.va
     reply.Err = OK
   } else {
     reply.Who = entry.who
-    reply.Np = entry.np
+    reply.Np = px.PromisedNumber(entry)
+    reply.Err = Reject
+  }
+
+  return nil
+}
+
+func (px *Paxos) HandlePrepareAll(args *PrepareAllArgs, reply *PrepareAllReply) error {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  px.UpdatePeerSeq(args.Peer, args.Seq, args.DoneSeq)
+
+  // like prepare(n), but for every instance >= seq,
+  // including the ones this peer has not heard of yet.
+
+  if args.N <= px.prepareAllN {
+    reply.Who = px.leader
+    reply.Np = px.prepareAllN
     reply.Err = Reject
+    return nil
   }
 
+  // the old promise still holds below args.Seq, so the
+  // new one may only widen the range.
+  if px.prepareAllN < 0 || args.Seq < px.prepareAllFrom {
+    px.prepareAllFrom = args.Seq
+  }
+  px.prepareAllN = args.N
+  px.leader = args.Peer
+  px.leaderTime = time.Now()
+  // must be on disk before the promise is sent
+  px.PersistState()
+
+  log.Printf("[px][%d] handle prepare all: args %+v", px.me, args)
+
+  for _, s := range px.logSeqs {
+    entry := px.logInstances[s]
+    if s >= args.Seq && entry.na >= 0 {
+      reply.Accepted = append(reply.Accepted, AcceptedInstance{ s, entry.na, entry.va })
+    }
+  }
+  reply.Err = OK
   return nil
 }
 
+//
+// the leader asks to propose v for seq on behalf of peer.
+//
+func (px *Paxos) HandleForward(args *ForwardArgs, reply *ForwardReply) error {
+  px.mu.Lock()
+  px.UpdatePeerSeq(args.Peer, args.Seq, args.DoneSeq)
+  isLeader := px.isLeader && args.Seq >= px.leaderFrom &&
+    px.ConfigFor(args.Seq).From == px.ConfigFor(px.leaderFrom).From
+  px.mu.Unlock()
+
+  if !isLeader {
+    reply.Err = Reject
+    return nil
+  }
+
+  log.Printf("[px][%d] handle forward: seq %d from peer %d", px.me, args.Seq, args.Peer)
+  px.Start(args.Seq, args.V)
+  reply.Err = OK
+  return nil
+}
 
 func (px *Paxos) HandleAccept(args *AcceptArgs, reply *AcceptReply) error {
   px.mu.Lock()
@@ -256,17 +445,24 @@ func (px *Paxos) HandleAccept(args *AcceptArgs, reply *AcceptReply) error {
 
   log.Printf("[px][%d] handle accept: args %+v entry %+v\n", px.me, args, entry)
 
-  if args.N >= entry.np {
+  if args.N >= px.PromisedNumber(entry) {
+    if args.N == px.prepareAllN {
+      // only the leader uses its PrepareAll number
+      px.leader = args.Peer
+      px.leaderTime = time.Now()
+    }
     entry.who = args.Peer
     entry.np = args.N
     entry.na = args.N
     entry.va = args.V
+    // must be on disk before the acceptance is sent
+    px.PersistInstance(entry)
     reply.Seq = args.Seq
     reply.N = args.N
     reply.Err = OK
   } else {
     reply.Who = entry.who
-    reply.Np = entry.np
+    reply.Np = px.PromisedNumber(entry)
     reply.Err = Reject
   }
 
@@ -282,9 +478,49 @@ func (px *Paxos) FindLargerNumber(n int) int {
   return num
 }
 
+//
+// remember the highest proposal number seen so far,
+// and which peer chose it.
+//
+func (px *Paxos) notePrepare(n int, who int) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  if px.maxPrepareSeen < n {
+    px.maxPrepareSeen = n
+    px.maxPrepareOwner = who
+  }
+}
+
+func (px *Paxos) highestPrepare() (int, int) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.maxPrepareSeen, px.maxPrepareOwner
+}
+
+//
+// a number for a new proposal by this peer, higher than any
+// seen or used so far. it is stored before anyone sees it,
+// so a restarted peer does not use the same number twice.
+//
+func (px *Paxos) NextNumber() int {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  n := px.maxPrepareSeen
+  if n < px.prepareAllN { n = px.prepareAllN }
+  n = px.FindLargerNumber(n)
+  px.maxPrepareSeen = n
+  px.maxPrepareOwner = px.me
+  px.PersistState()
+  return n
+}
+
 const (
   ShortWait = 5
   LongWait = 100
+  // a leader not heard from for this long is suspected dead
+  LeaderTimeout = 3 * time.Second
+  // how many ShortWaits to wait for a forwarded proposal
+  ForwardWaits = 200
 )
 
 func (px *Paxos) WaitForSomeMilliseconds(scale int) {
@@ -335,13 +571,16 @@ func (px *Paxos) DoPrepare(seq int, v interface{}) {
   //       send decided(v') to all
 
   go func() {
+    if px.DoLeaderPropose(seq, v) {
+      return
+    }
+
     px.WaitForSomeMilliseconds(ShortWait)
 
-    n := px.FindLargerNumber(px.me)
-    px.maxPrepareSeen = n
-    px.maxPrepareOwner = px.me
+    n := px.NextNumber()
 
-    numPeers := len(px.peers)
+    ids, addrs := px.MembersFor(seq)
+    numPeers := len(addrs)
     numAccepted := 0
     numRejected := 0
     peerStatus := make(map[string]Err)
@@ -369,7 +608,8 @@ func (px *Paxos) DoPrepare(seq int, v interface{}) {
 
       args := PrepareArgs { seq, n, px.me, px.doneSeq }
 
-      for pi, p := range px.peers {
+      for i, p := range addrs {
+        pi := ids[i]
         if px.dead { break }
 
         _, ok = peerStatus[p]
@@ -378,13 +618,10 @@ func (px *Paxos) DoPrepare(seq int, v interface{}) {
         }
 
         var reply PrepareReply
-        ok := callWithRetry(p, "Paxos.HandlePrepare", &args, &reply, 5)
+        ok := px.callPeer(pi, p, "Paxos.HandlePrepare", &args, &reply, 5)
         if ok {
           peerStatus[p] = reply.Err
-          if px.maxPrepareSeen < reply.Np {
-            px.maxPrepareSeen = reply.Np
-            px.maxPrepareOwner = reply.Who
-          }
+          px.notePrepare(reply.Np, reply.Who)
           if reply.Err == OK {
             numAccepted += 1
             if maxPeerAcceptedNum < reply.Na {
@@ -416,10 +653,11 @@ func (px *Paxos) DoPrepare(seq int, v interface{}) {
       px.WaitForSomeMilliseconds(ShortWait)
       if commitFailed || numRejected > 0 {
         // do a long wait if the competing proposer is greater than me
-        if px.maxPrepareOwner > px.me {
+        _, owner := px.highestPrepare()
+        if owner > px.me {
           px.WaitForSomeMilliseconds(LongWait)
         }
-        n = px.FindLargerNumber(px.maxPrepareSeen)
+        n = px.NextNumber()
         numAccepted = 0
         numRejected = 0
         peerStatus = make(map[string]Err)
@@ -432,8 +670,146 @@ func (px *Paxos) DoPrepare(seq int, v interface{}) {
   }()
 }
 
+//
+// try to get seq decided without a prepare phase: either
+// we lead, or we forward v to the leader, or nobody seems
+// to lead and we take over with a PrepareAll from seq on.
+// returns false if the caller has to run the full protocol.
+//
+func (px *Paxos) DoLeaderPropose(seq int, v interface{}) bool {
+  px.mu.Lock()
+  // a leader is only good for the members it prepared with
+  isLeader := px.isLeader && seq >= px.leaderFrom &&
+    px.ConfigFor(seq).From == px.ConfigFor(px.leaderFrom).From
+  leader := px.leader
+  alive := leader >= 0 && leader != px.me && time.Since(px.leaderTime) < LeaderTimeout
+  px.mu.Unlock()
+
+  if isLeader {
+    return px.DoLeaderAccept(seq, v)
+  }
+  if alive {
+    return px.DoForward(leader, seq, v)
+  }
+  if px.DoPrepareAll(seq) {
+    return px.DoLeaderAccept(seq, v)
+  }
+  return false
+}
+
+func (px *Paxos) DoPrepareAll(seq int) bool {
+  n := px.NextNumber()
+
+  ids, addrs := px.MembersFor(seq)
+  numPeers := len(addrs)
+  numAccepted := 0
+  values := make(map[int]interface{})
+  nas := make(map[int]int)
+
+  args := PrepareAllArgs { seq, n, px.me, px.doneSeq }
+  for i, p := range addrs {
+    pi := ids[i]
+    if px.dead { return false }
+
+    var reply PrepareAllReply
+    ok := px.callPeer(pi, p, "Paxos.HandlePrepareAll", &args, &reply, 5)
+    if !ok {
+      log.Printf("[px][%d] failed to call Paxos.HandlePrepareAll of peer %d", px.me, pi)
+      continue
+    }
+    if reply.Err == OK {
+      numAccepted += 1
+      for _, a := range reply.Accepted {
+        na, ok := nas[a.Seq]
+        if !ok || na < a.Na {
+          nas[a.Seq] = a.Na
+          values[a.Seq] = a.Va
+        }
+      }
+    } else {
+      px.notePrepare(reply.Np, reply.Who)
+    }
+  }
+
+  log.Printf("[px][%d] prepare all: seq %d n %d accept %d peers %d\n", px.me, seq, n, numAccepted, numPeers)
+
+  if numAccepted <= numPeers / 2 {
+    return false
+  }
+
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  px.isLeader = true
+  px.leaderN = n
+  px.leaderFrom = seq
+  px.leaderValues = values
+  return true
+}
+
+func (px *Paxos) DoLeaderAccept(seq int, v interface{}) bool {
+  px.mu.Lock()
+  n := px.leaderN
+  va, ok := px.leaderValues[seq]
+  if ok {
+    v = va
+  }
+  px.mu.Unlock()
+
+  if px.DoAccept(seq, v, n) {
+    px.DoNotify(seq, v, n)
+    return true
+  }
+
+  // someone else prepared a higher number
+  log.Printf("[px][%d] lost leadership at seq %d, n %d", px.me, seq, n)
+  px.mu.Lock()
+  if px.leaderN == n {
+    px.isLeader = false
+  }
+  px.mu.Unlock()
+  return false
+}
+
+func (px *Paxos) DoForward(leader int, seq int, v interface{}) bool {
+  args := ForwardArgs { seq, v, px.me, px.doneSeq }
+  var reply ForwardReply
+  px.mu.Lock()
+  addr := px.peers[leader]
+  px.mu.Unlock()
+  ok := call(addr, "Paxos.HandleForward", &args, &reply)
+  if !ok || reply.Err != OK {
+    log.Printf("[px][%d] leader %d did not take seq %d", px.me, leader, seq)
+    px.mu.Lock()
+    if px.leader == leader {
+      px.leader = -1
+    }
+    px.mu.Unlock()
+    return false
+  }
+
+  // the leader tells us the decision with HandleDecided
+  for i := 0; i < ForwardWaits && !px.dead; i++ {
+    if px.IsDecided(seq) {
+      return true
+    }
+    time.Sleep(ShortWait * time.Millisecond)
+  }
+  return false
+}
+
+func (px *Paxos) IsDecided(seq int) bool {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  if seq < px.minSeq {
+    return true
+  }
+  entry, ok := px.logInstances[seq]
+  return ok && entry.status == Decided
+}
+
 func (px *Paxos) DoAccept(seq int, v interface{}, n int) bool {
-  numPeers := len(px.peers)
+  ids, addrs := px.MembersFor(seq)
+  numPeers := len(addrs)
   numAccepted := 0
   numRejected := 0
   peerStatus := make(map[string]Err)
@@ -441,7 +817,8 @@ func (px *Paxos) DoAccept(seq int, v interface{}, n int) bool {
   args := AcceptArgs { seq, n, v, px.me, px.doneSeq }
   for !px.dead {
 
-    for pi, p := range px.peers {
+    for i, p := range addrs {
+      pi := ids[i]
       if px.dead { break }
 
       _, ok := peerStatus[p]
@@ -450,13 +827,10 @@ func (px *Paxos) DoAccept(seq int, v interface{}, n int) bool {
       }
 
       var reply AcceptReply
-      ok = callWithRetry(p, "Paxos.HandleAccept", &args, &reply, 5)
+      ok = px.callPeer(pi, p, "Paxos.HandleAccept", &args, &reply, 5)
       if ok {
         peerStatus[p] = reply.Err
-        if px.maxPrepareSeen < reply.Np {
-          px.maxPrepareSeen = reply.Np
-          px.maxPrepareOwner = reply.Who
-        }
+        px.notePrepare(reply.Np, reply.Who)
         if reply.Err == OK {
           numAccepted += 1
         } else if reply.Err == Reject {
@@ -486,18 +860,24 @@ func (px *Paxos) DoAccept(seq int, v interface{}, n int) bool {
 
 func (px *Paxos) DoNotify(seq int, v interface{}, n int) bool {
   // decided
-  numPeers := len(px.peers)
+  ids, addrs := px.MembersFor(seq)
+  numPeers := len(addrs)
   numNotified := 0
   peerStatus := make(map[string]Err)
 
-  args := DecidedArgs { seq, n, v, px.me, px.doneSeq }
+  px.mu.Lock()
+  minDone := px.GlobalMinDone()
+  px.mu.Unlock()
+
+  args := DecidedArgs { seq, n, v, px.me, px.doneSeq, minDone }
   for !px.dead {
-    for pi, p := range px.peers {
+    for i, p := range addrs {
+      pi := ids[i]
       if px.dead { break }
       err, ok := peerStatus[p]
       if ok && err == OK { continue }
       var reply DecidedReply
-      ok = callWithRetry(p, "Paxos.HandleDecided", &args, &reply, 5)
+      ok = px.callPeer(pi, p, "Paxos.HandleDecided", &args, &reply, 5)
       if ok {
         numNotified += 1
         peerStatus[p] = reply.Err
@@ -541,6 +921,7 @@ func (px *Paxos) Done(seq int) {
   log.Printf("[px][%d] done: seq %d\n", px.me, seq)
   if seq > px.doneSeq {
     px.doneSeq = seq
+    px.PersistState()
   }
 }
 
@@ -632,6 +1013,9 @@ func (px *Paxos) Kill() {
   if px.l != nil {
     px.l.Close()
   }
+  px.mu.Lock()
+  px.CloseStorage()
+  px.mu.Unlock()
 }
 
 //
@@ -640,20 +1024,51 @@ func (px *Paxos) Kill() {
 // are in peers[]. this servers port is peers[me].
 //
 func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
+  return MakePersistent(peers, me, rpcs, "")
+}
+
+//
+// like Make(), but the peer's acceptor state and Done()
+// sequence are kept in dir and reloaded from it, so a
+// peer restarted with the same dir keeps its promises.
+// an empty dir means nothing is stored.
+//
+func MakePersistent(peers []string, me int, rpcs *rpc.Server, dir string) *Paxos {
+  return MakeJoining(peers, me, rpcs, dir, 0)
+}
+
+//
+// like MakePersistent(), for a peer that becomes a member
+// at instance from, after a Reconfig decided at from - Alpha.
+// peers[] holds the addresses of the members from then on,
+// with "" for the indices of peers that are not members.
+// instances below from are treated as forgotten.
+//
+func MakeJoining(peers []string, me int, rpcs *rpc.Server, dir string, from int) *Paxos {
   px := &Paxos{}
-  px.peers = peers
+  px.peers = append([]string{}, peers...)
   px.me = me
+  px.dir = dir
+  px.configs = []membership{ membership{ from, membersOf(peers) } }
 
   // Your initialization code here.
   px.logSeqs = make([]int, 0, 100)
   px.logInstances = make(map[int]*LogInstance)
   px.peerDoneSeqs = make(map[int]int)
-  px.maxSeq = -1
-  px.minSeq = 0
-  px.doneSeq = -1
+  px.maxSeq = from - 1
+  px.minSeq = from
+  px.doneSeq = from - 1
+  px.decidedTo = from - 1
+  px.prepareAllN = -1
+  px.leader = -1
+  px.leaderN = -1
 
   log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
 
+  if dir != "" {
+    px.openStorage()
+  }
+
   if rpcs != nil {
     // caller will create socket &c
     rpcs.Register(px)
@@ -45,8 +45,42 @@ type DecidedArgs struct {
 	V interface {}
 	Peer int
 	DoneSeq int
+	// lowest Done() over all peers known to the sender, or -1
+	MinDone int
 }
 
 type DecidedReply struct {
 	Err Err
 }
+
+type PrepareAllArgs struct {
+	// prepare every instance >= Seq
+	Seq int
+	N int
+	Peer int
+	DoneSeq int
+}
+
+type AcceptedInstance struct {
+	Seq int
+	Na int
+	Va interface{}
+}
+
+type PrepareAllReply struct {
+	Who int
+	Np int
+	Accepted []AcceptedInstance
+	Err Err
+}
+
+type ForwardArgs struct {
+	Seq int
+	V interface{}
+	Peer int
+	DoneSeq int
+}
+
+type ForwardReply struct {
+	Err Err
+}
@@ -0,0 +1,245 @@
+package paxos
+
+//
+// Durable acceptor state, so a peer can crash and restart.
+//
+// The log is a file in the peer's storage directory. Each
+// record is a gob-encoded persistRecord prefixed by its
+// length, appended and synced before the handler that
+// produced it replies. On restart the records are replayed
+// in order; a torn record at the tail (crash in the middle
+// of a write) is cut off. The records also carry the highest
+// proposal number the peer has seen or used, so a restarted
+// proposer starts above it.
+//
+// When Min() advances far enough that most records in the
+// log are about forgotten instances, the log is rewritten
+// with only the instances that are still remembered.
+//
+// Kill() closes the log; writes after that are dropped, so
+// a dead peer cannot scribble on the log of the peer that
+// is restarted from the same directory.
+//
+
+import "os"
+import "io"
+import "bufio"
+import "bytes"
+import "encoding/gob"
+import "encoding/binary"
+import "path/filepath"
+import "log"
+
+const (
+  StorageFile = "acceptor.log"
+  // compact when the log holds more than CompactRatio
+  // records per remembered instance, and at least
+  // CompactMin records
+  CompactRatio = 4
+  CompactMin = 1000
+)
+
+type persistRecord struct {
+  // -1 if the record only carries the peer-wide fields below
+  Seq int
+  Who int
+  Np int
+  Na int
+  Va interface{}
+  Decided bool
+  DoneSeq int
+  MinSeq int
+  // the promise made to the leader, see HandlePrepareAll()
+  PrepareAllN int
+  PrepareAllFrom int
+  // highest proposal number seen or used, see NextNumber()
+  MaxN int
+  // set in records with Seq -1 only
+  Configs []membership
+  Peers []string
+}
+
+func writeRecord(w io.Writer, rec *persistRecord) error {
+  var buf bytes.Buffer
+  if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+    return err
+  }
+  var hdr [4]byte
+  binary.LittleEndian.PutUint32(hdr[:], uint32(buf.Len()))
+  _, err := w.Write(append(hdr[:], buf.Bytes()...))
+  return err
+}
+
+// returns the records and the length of the valid prefix of r.
+func readRecords(r io.Reader) ([]persistRecord, int64) {
+  var recs []persistRecord
+  var good int64 = 0
+  br := bufio.NewReader(r)
+  for {
+    var hdr [4]byte
+    if _, err := io.ReadFull(br, hdr[:]); err != nil {
+      break
+    }
+    body := make([]byte, binary.LittleEndian.Uint32(hdr[:]))
+    if _, err := io.ReadFull(br, body); err != nil {
+      break
+    }
+    var rec persistRecord
+    if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&rec); err != nil {
+      break
+    }
+    recs = append(recs, rec)
+    good += int64(len(hdr) + len(body))
+  }
+  return recs, good
+}
+
+func (px *Paxos) storagePath() string {
+  return filepath.Join(px.dir, StorageFile)
+}
+
+//
+// replay the log in px.dir and open it for appending.
+// called by MakePersistent() before the peer serves RPCs.
+//
+func (px *Paxos) openStorage() {
+  if err := os.MkdirAll(px.dir, 0777); err != nil {
+    log.Fatal("paxos storage: ", err)
+  }
+
+  f, err := os.OpenFile(px.storagePath(), os.O_RDWR|os.O_CREATE, 0666)
+  if err != nil {
+    log.Fatal("paxos storage: ", err)
+  }
+
+  recs, good := readRecords(f)
+  for _, rec := range recs {
+    if rec.DoneSeq > px.doneSeq { px.doneSeq = rec.DoneSeq }
+    if rec.MinSeq > px.minSeq { px.minSeq = rec.MinSeq }
+    px.prepareAllN = rec.PrepareAllN
+    px.prepareAllFrom = rec.PrepareAllFrom
+    if rec.MaxN > px.maxPrepareSeen { px.maxPrepareSeen = rec.MaxN }
+    if rec.Np > px.maxPrepareSeen { px.maxPrepareSeen = rec.Np }
+    if rec.PrepareAllN > px.maxPrepareSeen { px.maxPrepareSeen = rec.PrepareAllN }
+    if len(rec.Configs) > 0 {
+      px.configs = rec.Configs
+      for i := len(px.peers); i < len(rec.Peers); i++ {
+        px.peers = append(px.peers, rec.Peers[i])
+      }
+    }
+    if rec.Seq < 0 { continue }
+    entry, ok := px.logInstances[rec.Seq]
+    if !ok {
+      entry = &LogInstance{ rec.Seq, -1, -1, -1, nil, Unknown }
+      px.logInstances[rec.Seq] = entry
+      px.logSeqs = append(px.logSeqs, rec.Seq)
+    }
+    entry.who = rec.Who
+    entry.np = rec.Np
+    entry.na = rec.Na
+    entry.va = rec.Va
+    if rec.Decided {
+      entry.status = Decided
+      if r, ok := rec.Va.(Reconfig); ok {
+        px.ApplyReconfig(rec.Seq, r)
+      }
+    }
+    if px.maxSeq < rec.Seq { px.maxSeq = rec.Seq }
+  }
+
+  var activeSeqs []int
+  for _, s := range px.logSeqs {
+    if s < px.minSeq {
+      delete(px.logInstances, s)
+    } else {
+      activeSeqs = append(activeSeqs, s)
+    }
+  }
+  px.logSeqs = activeSeqs
+
+  // drop a torn record at the tail, if any
+  if err := f.Truncate(good); err != nil {
+    log.Fatal("paxos storage: ", err)
+  }
+  if _, err := f.Seek(good, io.SeekStart); err != nil {
+    log.Fatal("paxos storage: ", err)
+  }
+  px.storage = f
+  px.storageRecords = len(recs)
+
+  log.Printf("[px][%d] recovered %d records from %s, min seq %d, done seq %d, max seq %d, max n %d",
+    px.me, len(recs), px.storagePath(), px.minSeq, px.doneSeq, px.maxSeq, px.maxPrepareSeen)
+}
+
+func (px *Paxos) appendRecord(rec *persistRecord) {
+  if err := writeRecord(px.storage, rec); err != nil {
+    log.Fatal("paxos storage: ", err)
+  }
+  if err := px.storage.Sync(); err != nil {
+    log.Fatal("paxos storage: ", err)
+  }
+  px.storageRecords++
+}
+
+// hold px.mu before call this func
+func (px *Paxos) PersistInstance(entry *LogInstance) {
+  if px.storage == nil { return }
+  px.appendRecord(&persistRecord{ entry.seq, entry.who, entry.np, entry.na, entry.va,
+    entry.status == Decided, px.doneSeq, px.minSeq, px.prepareAllN, px.prepareAllFrom, px.maxPrepareSeen, nil, nil })
+}
+
+// hold px.mu before call this func
+func (px *Paxos) PersistState() {
+  if px.storage == nil { return }
+  px.appendRecord(&persistRecord{ -1, -1, -1, -1, nil, false, px.doneSeq, px.minSeq,
+    px.prepareAllN, px.prepareAllFrom, px.maxPrepareSeen, px.configs, px.peers })
+}
+
+//
+// close the log. called by Kill().
+// hold px.mu before call this func
+//
+func (px *Paxos) CloseStorage() {
+  if px.storage == nil { return }
+  px.storage.Close()
+  px.storage = nil
+}
+
+//
+// rewrite the log with the instances >= px.minSeq, if
+// enough of it is about forgotten instances.
+// hold px.mu before call this func
+//
+func (px *Paxos) CompactStorage() {
+  if px.storage == nil { return }
+  live := len(px.logSeqs) + 1
+  if px.storageRecords < CompactMin || px.storageRecords < CompactRatio * live {
+    return
+  }
+
+  tmp := px.storagePath() + ".tmp"
+  f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+  if err != nil {
+    log.Fatal("paxos storage: ", err)
+  }
+  w := bufio.NewWriter(f)
+  err = writeRecord(w, &persistRecord{ -1, -1, -1, -1, nil, false, px.doneSeq, px.minSeq,
+    px.prepareAllN, px.prepareAllFrom, px.maxPrepareSeen, px.configs, px.peers })
+  for _, s := range px.logSeqs {
+    if err != nil { break }
+    entry := px.logInstances[s]
+    err = writeRecord(w, &persistRecord{ entry.seq, entry.who, entry.np, entry.na, entry.va,
+      entry.status == Decided, px.doneSeq, px.minSeq, px.prepareAllN, px.prepareAllFrom, px.maxPrepareSeen, nil, nil })
+  }
+  if err == nil { err = w.Flush() }
+  if err == nil { err = f.Sync() }
+  if err == nil { err = os.Rename(tmp, px.storagePath()) }
+  if err != nil {
+    log.Fatal("paxos storage: ", err)
+  }
+
+  px.storage.Close()
+  px.storage = f
+  px.storageRecords = live
+  log.Printf("[px][%d] compacted storage: %d instances, min seq %d", px.me, len(px.logSeqs), px.minSeq)
+}
@@ -19,6 +19,10 @@ func port(tag string, host int) string {
   return s
 }
 
+func storagedir(tag string, host int) string {
+  return port(tag, host) + ".d"
+}
+
 func ndecided(t *testing.T, pxa []*Paxos, seq int) int {
   count := 0
   var v interface{}
@@ -55,6 +59,29 @@ func waitn(t *testing.T, pxa[]*Paxos, seq int, wanted int) {
   }
 }
 
+//
+// like waitn(), for values that are not comparable.
+//
+func waitdecided(t *testing.T, pxa []*Paxos, seq int, wanted int) {
+  for iters := 0; ; iters++ {
+    nd := 0
+    for i := 0; i < len(pxa); i++ {
+      if pxa[i] != nil {
+        if decided, _ := pxa[i].Status(seq); decided {
+          nd++
+        }
+      }
+    }
+    if nd >= wanted {
+      return
+    }
+    if iters > 100 {
+      t.Fatalf("too few decided; seq=%v ndecided=%v wanted=%v", seq, nd, wanted)
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+}
+
 func waitmajority(t *testing.T, pxa[]*Paxos, seq int) {
   waitn(t, pxa, seq, (len(pxa) / 2) + 1)
 }
@@ -98,7 +125,11 @@ func noTestSpeed(t *testing.T) {
   }
 
   d := time.Since(t0)
-  fmt.Printf("20 agreements %v seconds\n", d.Seconds())
+  total := 0
+  for j := 0; j < npaxos; j++ {
+    total += pxa[j].rpcCount
+  }
+  fmt.Printf("20 agreements %v seconds, %v RPCs\n", d.Seconds(), total)
 }
 
 func TestBasic(t *testing.T) {
@@ -161,6 +192,116 @@ func TestBasic(t *testing.T) {
   fmt.Printf("  ... Passed\n")
 }
 
+//
+// acceptors that restart with their storage directory
+// must remember what they promised and accepted.
+//
+func TestPersistentRestart(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("persist", i)
+    os.RemoveAll(storagedir("persist", i))
+    defer os.RemoveAll(storagedir("persist", i))
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = MakePersistent(pxh, i, nil, storagedir("persist", i))
+  }
+
+  fmt.Printf("Test: Decided values survive restart ...\n")
+
+  pxa[0].Start(0, "hello")
+  waitn(t, pxa, 0, npaxos)
+
+  for i := 0; i < npaxos; i++ {
+    pxa[i].Done(0)
+    pxa[i].Kill()
+    pxa[i] = MakePersistent(pxh, i, nil, storagedir("persist", i))
+  }
+  if ndecided(t, pxa, 0) != npaxos {
+    t.Fatalf("a restarted peer forgot a decision")
+  }
+  pxa[1].Start(0, "goodbye")
+  pxa[2].Start(1, "world")
+  waitn(t, pxa, 1, npaxos)
+  waitn(t, pxa, 0, npaxos)
+  if _, v := pxa[1].Status(0); v != "hello" {
+    t.Fatalf("decision changed after restart; got %v", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Accepted values survive restart ...\n")
+
+  // a majority accepts "x" for seq 2, but nobody learns
+  // that it was chosen before every peer restarts.
+  for i := 0; i < 2; i++ {
+    args := AcceptArgs{ 2, 100000, "x", 0, -1 }
+    var reply AcceptReply
+    pxa[i].HandleAccept(&args, &reply)
+    if reply.Err != OK {
+      t.Fatalf("peer %v did not accept", i)
+    }
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i].Kill()
+    pxa[i] = MakePersistent(pxh, i, nil, storagedir("persist", i))
+  }
+  pxa[2].Start(2, "y")
+  waitn(t, pxa, 2, npaxos)
+  if _, v := pxa[2].Status(2); v != "x" {
+    t.Fatalf("restarted acceptors lost an accepted value; got %v", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Restarted proposer picks a new number ...\n")
+
+  // peer 2 gets promises for seq 3 from the others, and
+  // crashes before it prepares itself or accepts anything.
+  n := pxa[2].NextNumber()
+  for i := 0; i < 2; i++ {
+    args := PrepareArgs{ 3, n, 2, -1 }
+    var reply PrepareReply
+    pxa[i].HandlePrepare(&args, &reply)
+    if reply.Err != OK {
+      t.Fatalf("peer %v did not promise", i)
+    }
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i].Kill()
+    pxa[i] = MakePersistent(pxh, i, nil, storagedir("persist", i))
+  }
+  for i := 0; i < npaxos; i++ {
+    if n1 := pxa[i].NextNumber(); n1 <= n {
+      t.Fatalf("peer %v picked %v after restart; %v was already used", i, n1, n)
+    }
+  }
+  pxa[2].Start(3, "z")
+  waitn(t, pxa, 3, npaxos)
+  if _, v := pxa[0].Status(3); v != "z" {
+    t.Fatalf("wrong value %v after restart; expected z", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Restarted peer keeps forgetting ...\n")
+
+  m := pxa[0].Min()
+  pxa[0].Kill()
+  pxa[0] = MakePersistent(pxh, 0, nil, storagedir("persist", 0))
+  if pxa[0].Min() != m {
+    t.Fatalf("wrong Min() after restart %v; expected %v", pxa[0].Min(), m)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
 func TestDeaf(t *testing.T) {
   runtime.GOMAXPROCS(4)
 
@@ -453,11 +594,14 @@ func TestRPCCount(t *testing.T) {
     total1 += pxa[j].rpcCount
   }
 
-  // per agreement:
+  // first agreement:
   // 3 prepares
   // 3 accepts
   // 3 decides
-  expected1 := ninst1 * npaxos * npaxos
+  // later agreements, by the leader:
+  // 3 accepts
+  // 3 decides
+  expected1 := npaxos * npaxos + (ninst1 - 1) * (npaxos + npaxos)
   if total1 > expected1 {
     t.Fatalf("too many RPCs for serial Start()s; %v instances, got %v, expected %v",
       ninst1, total1, expected1)
@@ -481,10 +625,10 @@ func TestRPCCount(t *testing.T) {
   total2 -= total1
 
   // per agreement:
-  // 9 prepares
-  // 9 accepts
-  // 9 decides
-  expected2 := ninst2 * npaxos * (npaxos + npaxos + npaxos)
+  // 2 forwards to the leader
+  // 3 accepts
+  // 3 decides
+  expected2 := ninst2 * ((npaxos - 1) + npaxos + npaxos)
   if total2 > expected2 {
     t.Fatalf("too many RPCs for concurrent Start()s; %v instances, got %v, expected %v",
       ninst2, total2, expected2)
@@ -580,6 +724,249 @@ func TestOld(t *testing.T) {
   fmt.Printf("  ... Passed\n")
 }
 
+//
+// replace peer 0 with a new peer 3 through the log.
+//
+func TestReconfig(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Replace a peer by reconfiguration ...\n")
+
+  const npaxos = 4
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("reconf", i)
+  }
+  for i := 0; i < 3; i++ {
+    pxa[i] = Make(pxh[:3], i, nil)
+  }
+
+  seq := 0
+  for ; seq < 3; seq++ {
+    pxa[seq % 3].Start(seq, seq * 10)
+    waitn(t, pxa, seq, 3)
+  }
+
+  newpeers := []string{"", pxh[1], pxh[2], pxh[3]}
+  pxa[1].Start(seq, Reconfig{ newpeers })
+  waitdecided(t, pxa, seq, 3)
+  from := seq + Alpha
+  pxa[3] = MakeJoining(newpeers, 3, nil, "", from)
+  pxa[0].Kill()
+  pxa[0] = nil
+  seq++
+  pxa[1].Done(seq - 1)
+  pxa[2].Done(seq - 1)
+
+  // the old members still decide instances below from;
+  // to the new peer they look forgotten.
+  for ; seq < from; seq++ {
+    pxa[1].Start(seq, seq * 10)
+    waitn(t, pxa[:3], seq, 2)
+  }
+  // peer 0 is still a member until from, and never
+  // called Done().
+  if pxa[2].Min() != 0 {
+    t.Fatalf("wrong Min() %v before from; expected 0", pxa[2].Min())
+  }
+  if pxa[3].Min() != from {
+    t.Fatalf("wrong Min() %v on new peer; expected %v", pxa[3].Min(), from)
+  }
+
+  // and all the new members from then on.
+  for ; seq < from + 3; seq++ {
+    pxa[1 + (seq % 3)].Start(seq, seq * 10)
+    waitn(t, pxa, seq, 3)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Min() ignores removed peers ...\n")
+
+  for i := 1; i < npaxos; i++ {
+    pxa[i].Done(from)
+  }
+  for i := 1; i < npaxos; i++ {
+    pxa[i].Start(seq, "x")
+    waitn(t, pxa, seq, 3)
+    seq++
+  }
+  for i := 1; i < npaxos; i++ {
+    if pxa[i].Min() != from + 1 {
+      t.Fatalf("wrong Min() %v; expected %v", pxa[i].Min(), from + 1)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: New majority decides without old peers ...\n")
+
+  pxa[1].Kill()
+  pxa[1] = nil
+  pxa[3].Start(seq, "y")
+  waitn(t, pxa, seq, 2)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// concurrent Submit()s share instances.
+//
+func TestBatcher(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Batched proposals ...\n")
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  var ba []*Batcher = make([]*Batcher, npaxos)
+  defer cleanup(pxa)
+
+  same := func(a interface{}, b interface{}) bool { return a == b }
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("batch", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil)
+    ba[i] = MakeBatcher(pxa[i], 10 * time.Millisecond, same)
+  }
+
+  const nvalues = 30
+  seqs := make(chan [2]int, nvalues)
+  for v := 0; v < nvalues; v++ {
+    go func(v int) {
+      seqs <- [2]int{ v, ba[v % npaxos].Submit(v) }
+    }(v)
+  }
+
+  for i := 0; i < nvalues; i++ {
+    vs := <- seqs
+    if vs[1] < 0 {
+      t.Fatalf("Submit(%v) failed", vs[0])
+    }
+    waitdecided(t, pxa, vs[1], npaxos)
+    _, batch := pxa[0].Status(vs[1])
+    found := false
+    for _, x := range batch.(Batch).Values {
+      if x == vs[0] {
+        found = true
+      }
+    }
+    if !found {
+      t.Fatalf("value %v not in batch at seq %v", vs[0], vs[1])
+    }
+  }
+  if pxa[0].Max() >= nvalues / 2 {
+    t.Fatalf("too many instances for %v values: %v", nvalues, pxa[0].Max() + 1)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// batched proposals go on while a Reconfig is decided, and
+// a peer that missed decisions does not propose Alpha or
+// more past them, where it might not know the members.
+//
+func TestBatcherReconfig(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "batchreconf"
+  const npaxos = 4
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh [][]string = make([][]string, npaxos)
+  var ba []*Batcher = make([]*Batcher, npaxos)
+  defer cleanup(pxa)
+  defer cleanpp(tag, npaxos)
+
+  same := func(a interface{}, b interface{}) bool { return a == b }
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = make([]string, npaxos)
+    for j := 0; j < npaxos; j++ {
+      if j == i {
+        pxh[i][j] = port(tag, i)
+      } else {
+        pxh[i][j] = pp(tag, i, j)
+      }
+    }
+  }
+  for i := 0; i < 3; i++ {
+    pxa[i] = Make(pxh[i][:3], i, nil)
+    ba[i] = MakeBatcher(pxa[i], 10 * time.Millisecond, same)
+  }
+  part(t, tag, npaxos, []int{0,1,2}, []int{}, []int{})
+
+  fmt.Printf("Test: Batched proposals across a Reconfig ...\n")
+
+  const nvalues = 20
+  seqs := make(chan [2]int, 2 * nvalues)
+  submit := func(b *Batcher, v int) {
+    seqs <- [2]int{ v, b.Submit(v) }
+  }
+  check := func(vs [2]int) {
+    if vs[1] < 0 {
+      t.Fatalf("Submit(%v) failed", vs[0])
+    }
+    waitdecided(t, pxa, vs[1], 2)
+    for i := 0; i < npaxos; i++ {
+      if decided, batch := pxa[i].Status(vs[1]); decided && vs[1] >= pxa[i].Min() {
+        if !ba[i].contains(batch.(Batch), vs[0]) {
+          t.Fatalf("value %v not in batch at seq %v on peer %v", vs[0], vs[1], i)
+        }
+      }
+    }
+  }
+  for v := 0; v < nvalues; v++ {
+    go submit(ba[v % 2], v)
+  }
+
+  // peer 2 misses the Reconfig and what follows it.
+  part(t, tag, npaxos, []int{0,1}, []int{2}, []int{})
+  newpeers := []string{ "", pxh[1][1], pxh[1][2], pxh[1][3] }
+  seq := pxa[1].Max() + 1
+  for ; ; seq++ {
+    pxa[1].Start(seq, Reconfig{ newpeers })
+    waitdecided(t, pxa[:2], seq, 2)
+    if _, v := pxa[1].Status(seq); v != nil {
+      if _, ok := v.(Reconfig); ok {
+        break
+      }
+    }
+  }
+  from := seq + Alpha
+  pxa[3] = MakeJoining([]string{ "", pxh[3][1], pxh[3][2], pxh[3][3] }, 3, nil, "", from)
+  ba[3] = MakeBatcher(pxa[3], 10 * time.Millisecond, same)
+  part(t, tag, npaxos, []int{0,1,3}, []int{2}, []int{})
+
+  for i := 0; i < nvalues; i++ {
+    check(<- seqs)
+  }
+  for v := nvalues; pxa[1].Max() < from + 2 * Alpha; v++ {
+    go submit(ba[1 + 2 * (v % 2)], v)
+    check(<- seqs)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Lagging peer proposes where it knows the members ...\n")
+
+  part(t, tag, npaxos, []int{0,1,2,3}, []int{}, []int{})
+  check([2]int{ 1000, ba[1].Submit(1000) })
+  s := ba[2].Submit(1001)
+  check([2]int{ 1001, s })
+  if pxa[2].DecidedUpTo() < s - Alpha {
+    t.Fatalf("peer 2 proposed at %v having decided only up to %v",
+      s, pxa[2].DecidedUpTo())
+  }
+  waitdecided(t, pxa[1:], s, 3)
+
+  fmt.Printf("  ... Passed\n")
+}
+
 //
 // many agreements, with unreliable RPC
 //
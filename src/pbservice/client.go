@@ -4,15 +4,37 @@ import "viewservice"
 import "net/rpc"
 // You'll probably need to uncomment this:
 import "time"
+import "sync"
+import "crypto/rand"
+import "math/big"
 
 
 type Clerk struct {
   vs *viewservice.Clerk
+  mu sync.Mutex // one Put at a time
+  clientId int64
+  // the seq of the latest Put
+  seq int64
+}
+
+func nrand() int64 {
+  max := big.NewInt(int64(1) << 62)
+  bigx, _ := rand.Int(rand.Reader, max)
+  return bigx.Int64()
 }
 
 func MakeClerk(vshost string, me string) *Clerk {
+  return MakeClerkVS([]string{ vshost }, me)
+}
+
+//
+// like MakeClerk(), with a replicated view service whose
+// replicas are at vshosts.
+//
+func MakeClerkVS(vshosts []string, me string) *Clerk {
   ck := new(Clerk)
-  ck.vs = viewservice.MakeClerk(me, vshost)
+  ck.vs = viewservice.MakeClerkReplicas(me, vshosts)
+  ck.clientId = nrand()
   return ck
 }
 
@@ -85,6 +107,35 @@ func (ck *Clerk) Get(key string) string {
 // must keep trying until it succeeds.
 //
 func (ck *Clerk) Put(key string, value string) {
+  ck.put(key, value, OpPut)
+}
+
+//
+// append value to key's value.
+// must keep trying until it succeeds.
+//
+func (ck *Clerk) Append(key string, value string) {
+  ck.put(key, value, OpAppend)
+}
+
+//
+// set key's value to hash(previous value + value), and
+// return the previous value ("" if there was none).
+// must keep trying until it succeeds.
+//
+func (ck *Clerk) PutHash(key string, value string) string {
+  return ck.put(key, value, OpPutHash)
+}
+
+//
+// send a Put, under one seq however often it is retried,
+// and return the previous value.
+//
+func (ck *Clerk) put(key string, value string, op string) string {
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+  ck.seq++
+
   for true {
     view, ok := ck.vs.Get()
     if !ok {
@@ -94,14 +145,19 @@ func (ck *Clerk) Put(key string, value string) {
     args := &PutArgs{}
     args.Key = key
     args.Value = value
+    args.Op = op
+    args.ClientId = ck.clientId
+    args.Seq = ck.seq
     var reply PutReply
     ok = call(primary, "PBServer.Put", args, &reply)
     if ok {
       if reply.Err == OK {
-        break
+        return reply.PreviousValue
       } else {
         time.Sleep(viewservice.PingInterval)
       }
     }
   }
+
+  return ""
 }
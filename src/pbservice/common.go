@@ -1,21 +1,45 @@
 package pbservice
 
+import "hash/fnv"
+
 const (
   OK = "OK"
   ErrNoKey = "ErrNoKey"
   ErrWrongServer = "ErrWrongServer"
   ErrForwardBackup = "ErrForwardBackup"
   ErrNetworkFailure = "ErrNetworkFailure"
+  // a Transfer chunk that does not start where the backup is
+  ErrOutOfOrder = "ErrOutOfOrder"
 )
 type Err string
 
+const (
+  OpPut = "Put"
+  // append Value to the key's value
+  OpAppend = "Append"
+  // set the key's value to hash(previous value + Value)
+  OpPutHash = "PutHash"
+)
+
 type PutArgs struct {
   Key string
   Value string
+  Op string // OpPut, OpAppend or OpPutHash; "" is OpPut
+  // a Clerk numbers its requests 1, 2, ...; a retry keeps
+  // the number, so the primary applies it at most once
+  ClientId int64
+  Seq int64
 }
 
 type PutReply struct {
   Err Err
+  PreviousValue string // the value before the Put
+}
+
+// the latest Put applied for a clerk, and its reply
+type DupEntry struct {
+  Seq int64
+  PreviousValue string
 }
 
 type GetArgs struct {
@@ -28,19 +52,45 @@ type GetReply struct {
 }
 
 // Your RPC definitions here.
-type SnapshotArgs struct {
-  Values map[string]string
+type TransferArgs struct {
+  // the view number that made the backup
+  Xfer uint
+  // the positions in the primary's sorted keys this chunk
+  // covers, From up to but not including To
+  From int
+  To int
+  Keys []string
+  Values []string
+  // the last chunk, which carries the duplicate table
+  Last bool
+  Dups map[int64]DupEntry
 }
 
-type SnapshotReply struct {
+type TransferReply struct {
   Err Err
+  // with ErrOutOfOrder, the position the backup is at
+  Cursor int
 }
 
+//
+// the outcome of a Put at the primary: the key's new value,
+// and the duplicate table entry for the clerk.
+//
 type ForwardPutArgs struct {
   Key string
   Value string
+  Xfer uint
+  ClientId int64
+  Seq int64
+  PreviousValue string
 }
 
 type ForwardPutReply struct {
   Err Err
 }
+
+func hash(s string) uint32 {
+  h := fnv.New32a()
+  h.Write([]byte(s))
+  return h.Sum32()
+}
@@ -10,6 +10,7 @@ import "sync"
 import "os"
 import "syscall"
 import "math/rand"
+import "strconv"
 
 
 type PBServer struct {
@@ -24,6 +25,25 @@ type PBServer struct {
   staleView bool
   values map[string]string
   view viewservice.View
+  // as the primary: the backups of the latest view, and the
+  // copy to each of them, done or not; see transfer.go
+  backups []string
+  xfers map[string]*transfer
+  // as a backup: the transfer being received, how far it
+  // has got, whether the last chunk is in, and the keys Puts
+  // were forwarded for since
+  recvXfer uint
+  recvCursor int
+  recvDone bool
+  forwarded map[string]bool
+  // the view number sent with the latest Ping
+  acked uint
+  // one entry per clerk, by ClientId
+  dups map[int64]DupEntry
+  // the keys of the Puts being forwarded, which hold up
+  // other Puts of them and their chunks; signalled on idle
+  busy map[string]bool
+  idle *sync.Cond
 }
 
 func (pb *PBServer) Get(args *GetArgs, reply *GetReply) error {
@@ -69,47 +89,71 @@ func (pb *PBServer) Put(args *PutArgs, reply *PutReply) error {
   pb.mu.Lock()
   defer pb.mu.Unlock()
 
+  // Puts of a key go one at a time, so that the backups
+  // get its values in order, but pb.mu is not held while
+  // they are forwarded
+  for pb.busy[args.Key] && pb.view.Primary == pb.me {
+    pb.idle.Wait()
+  }
+
   if pb.view.Primary != pb.me {
     reply.Err = ErrWrongServer
     return nil
   }
 
+  if last, ok := pb.dups[args.ClientId]; ok && args.Seq <= last.Seq {
+    // a retry; the clerk only waits for its latest Put
+    reply.Err = OK
+    if args.Seq == last.Seq {
+      reply.PreviousValue = last.PreviousValue
+    }
+    return nil
+  }
+
+  prev := pb.values[args.Key]
+  value := args.Value
+  if args.Op == OpAppend {
+    value = prev + args.Value
+  } else if args.Op == OpPutHash {
+    value = strconv.Itoa(int(hash(prev + args.Value)))
+  }
+
+  // the backup gets the outcome, not the op, so a forward
+  // that is sent again changes nothing. every backup must
+  // have it before the primary applies it.
+  pb.busy[args.Key] = true
+  forwards := pb.ForwardTo(args.Key)
+  pb.mu.Unlock()
+
   reply.Err = OK
-  if pb.view.Backup != "" {
-    forward := ForwardPutArgs{args.Key, args.Value}
+  for _, x := range forwards {
+    forward := ForwardPutArgs{args.Key, value, x.viewnum, args.ClientId, args.Seq, prev}
     var backup_reply ForwardPutReply
-    ok := call(pb.view.Backup, "PBServer.ForwardPut", &forward, &backup_reply)
+    ok := call(x.backup, "PBServer.ForwardPut", &forward, &backup_reply)
     if !ok {
       fmt.Printf("Failed to call PBServer.ForwardPut on backup '%s': (%s, %s)\n",
-        pb.view.Backup, forward.Key, forward.Value)
+        x.backup, forward.Key, forward.Value)
       reply.Err = ErrNetworkFailure
-    } else {
-      if backup_reply.Err == ErrWrongServer {
-        fmt.Printf("Forward to the wrong server: '%s'\n", pb.view.Backup)
-        reply.Err = ErrForwardBackup
-      }
+      break
+    } else if backup_reply.Err == ErrWrongServer {
+      fmt.Printf("Forward to the wrong server: '%s'\n", x.backup)
+      reply.Err = ErrForwardBackup
+      break
     }
   }
 
-  if reply.Err == OK {
-    pb.values[args.Key] = args.Value
-  }
-
-  return nil
-}
-
-func (pb *PBServer) SendSnapshot(args *SnapshotArgs, reply *SnapshotReply) error {
   pb.mu.Lock()
-  defer pb.mu.Unlock()
-
-  if pb.view.Backup != pb.me {
-    fmt.Printf("SendSnapshot: I'm not backup server: '%s'\n", pb.me)
+  delete(pb.busy, args.Key)
+  pb.idle.Broadcast()
+  if reply.Err == OK && pb.view.Primary != pb.me {
     reply.Err = ErrWrongServer
-    return nil
+  }
+  if reply.Err == OK {
+    pb.values[args.Key] = value
+    pb.dups[args.ClientId] = DupEntry{ args.Seq, prev }
+    reply.PreviousValue = prev
   }
 
-  pb.values = args.Values
-  reply.Err = OK
   return nil
 }
 
@@ -117,13 +161,16 @@ func (pb *PBServer) ForwardPut(args *ForwardPutArgs, reply *ForwardPutReply) err
   pb.mu.Lock()
   defer pb.mu.Unlock()
 
-  if pb.view.Backup != pb.me {
+  if !pb.view.IsBackup(pb.me) {
     fmt.Printf("ForwardPut: I'm not backup server: '%s'\n", pb.me)
     reply.Err = ErrWrongServer
     return nil
   }
 
+  pb.RecvStart(args.Xfer)
+  pb.forwarded[args.Key] = true
   pb.values[args.Key] = args.Value
+  pb.MergeDup(args.ClientId, DupEntry{ args.Seq, args.PreviousValue })
   reply.Err = OK
   return nil
 }
@@ -132,7 +179,9 @@ func (pb *PBServer) ForwardPut(args *ForwardPutArgs, reply *ForwardPutReply) err
 // ping the viewserver periodically.
 // if view changed:
 //   transition to new view.
-//   manage transfer of state from primary to new backup.
+//   manage transfer of state from primary to new backup,
+//   which goes on in the background (see transfer.go); the
+//   backup acknowledges the view when it is done.
 //
 func (pb *PBServer) tick() {
   view, ok := pb.vs.Get()
@@ -150,35 +199,41 @@ func (pb *PBServer) tick() {
   // fmt.Printf("viewnum: %d, me: %s, p: %s, b: %s\n", view.Viewnum, pb.me, view.Primary, view.Backup)
   pb.mu.Lock()
   defer pb.mu.Unlock()
-  update_view := true
   if view.Primary == pb.me {
-    if view.Backup == "" {
-      update_view = true
-    } else if view.Backup != pb.view.Backup {
-      snapshot := SnapshotArgs{pb.values}
-      var reply SnapshotReply
-      ok := call(view.Backup, "PBServer.SendSnapshot", &snapshot, &reply)
-      if !ok {
-        fmt.Printf("Failed to call PBServer.SendSnapshot on backup: '%s'\n", view.Backup)
-        update_view = false
-      } else if reply.Err == OK {
-        fmt.Printf("Successfully send snapshot to backup: '%s'\n", view.Backup)
-        update_view = true
-      } else {
-        fmt.Printf("Failed to send snapshot to backup '%s': %s\n", view.Backup, reply.Err)
-        update_view = false
+    for backup := range pb.xfers {
+      if !view.IsBackup(backup) {
+        delete(pb.xfers, backup)
       }
     }
+    pb.backups = view.Backups
+    for _, backup := range view.Backups {
+      if pb.xfers[backup] == nil {
+        pb.StartTransfer(view, backup)
+      }
+    }
+  } else {
+    // so a backup that is promoted copies to all its backups
+    pb.backups = nil
+    pb.xfers = make(map[string]*transfer)
   }
-  // if view.Backup == pb.Me {
-  //   if pb.view.Backup != pb.Me {
-  //     
-  //   }
-  // }
-  if update_view {
-    pb.view = view
+  if !view.IsBackup(pb.me) {
+    // a transfer received before is out of date by the
+    // time this server is a backup again
+    pb.recvXfer = 0
+    pb.recvDone = false
   }
-  pb.vs.Ping(pb.view.Viewnum)
+  pb.view = view
+
+  // the viewservice only promotes a backup that has
+  // acknowledged a view since it became one, so a backup
+  // acknowledges the view of the transfer it has all of,
+  // and until then the view it acknowledged before
+  if !view.IsBackup(pb.me) {
+    pb.acked = view.Viewnum
+  } else if pb.recvDone {
+    pb.acked = pb.recvXfer
+  }
+  pb.vs.Ping(pb.acked)
 }
 
 // tell the server to shut itself down.
@@ -190,13 +245,26 @@ func (pb *PBServer) kill() {
 
 
 func StartServer(vshost string, me string) *PBServer {
+  return StartServerVS([]string{ vshost }, me)
+}
+
+//
+// like StartServer(), with a replicated view service whose
+// replicas are at vshosts.
+//
+func StartServerVS(vshosts []string, me string) *PBServer {
   pb := new(PBServer)
   pb.me = me
-  pb.vs = viewservice.MakeClerk(me, vshost)
+  pb.vs = viewservice.MakeClerkReplicas(me, vshosts)
   // Your pb.* initializations here.
   pb.staleView = true
   pb.lastGetViewTime = time.Now()
   pb.values = make(map[string]string)
+  pb.forwarded = make(map[string]bool)
+  pb.dups = make(map[int64]DupEntry)
+  pb.xfers = make(map[string]*transfer)
+  pb.busy = make(map[string]bool)
+  pb.idle = sync.NewCond(&pb.mu)
 
   rpcs := rpc.NewServer()
   rpcs.Register(pb)
@@ -879,3 +879,360 @@ func TestPartition2(t *testing.T) {
   s3.kill()
   vs.Kill()
 }
+
+// a backup that takes many Transfer chunks, while Puts go on.
+func TestBigTransfer(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "bigtransfer"
+  vshost := port(tag+"v", 1)
+  vs := viewservice.StartServer(vshost)
+  time.Sleep(time.Second)
+  vck := viewservice.MakeClerk("", vshost)
+
+  s1 := StartServer(vshost, port(tag, 1))
+  deadtime := viewservice.PingInterval * viewservice.DeadPings
+  time.Sleep(deadtime * 2)
+  if vck.Primary() != s1.me {
+    t.Fatal("first primary never formed view")
+  }
+
+  fmt.Printf("Test: Chunked transfer to a new backup, with Puts ...\n")
+
+  const nkeys = 1000
+  big := make([]byte, 1000)
+  for i := range big {
+    big[i] = 'a' + byte(i % 26)
+  }
+  ck := MakeClerk(vshost, "")
+  for i := 0; i < nkeys; i++ {
+    ck.Put(strconv.Itoa(i), string(big))
+  }
+
+  // each writer has its own keys, old and new ones, so the
+  // last value it Put is the one to find
+  const nwriters = 4
+  done := false
+  last := make([]map[string]string, nwriters)
+  finished := make(chan bool)
+  for w := 0; w < nwriters; w++ {
+    last[w] = make(map[string]string)
+    go func(me int) {
+      myck := MakeClerk(vshost, "")
+      for i := 0; !done; i++ {
+        key := strconv.Itoa((i * nwriters + me) % (2 * nkeys))
+        value := strconv.Itoa(i)
+        myck.Put(key, value)
+        last[me][key] = value
+      }
+      finished <- true
+    }(w)
+  }
+
+  s2 := StartServer(vshost, port(tag, 2))
+  transferred := func() bool {
+    s1.mu.Lock()
+    defer s1.mu.Unlock()
+    x := s1.xfers[s2.me]
+    return s1.view.Backup == s2.me && x != nil && x.done
+  }
+  for iter := 0; iter < 50; iter++ {
+    if transferred() {
+      break
+    }
+    time.Sleep(viewservice.PingInterval)
+  }
+  if !transferred() {
+    t.Fatalf("transfer to the backup never finished")
+  }
+
+  time.Sleep(3 * viewservice.PingInterval)
+  done = true
+  for w := 0; w < nwriters; w++ {
+    <- finished
+  }
+
+  s1.kill()
+  for iter := 0; iter < viewservice.DeadPings * 3; iter++ {
+    if vck.Primary() == s2.me {
+      break
+    }
+    time.Sleep(viewservice.PingInterval)
+  }
+  if vck.Primary() != s2.me {
+    t.Fatalf("backup never switched to primary")
+  }
+
+  for i := 0; i < 2 * nkeys; i++ {
+    key := strconv.Itoa(i)
+    value, ok := last[i % nwriters][key]
+    if !ok && i < nkeys {
+      value = string(big)
+    }
+    check(ck, key, value)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  s1.kill()
+  s2.kill()
+  vs.Kill()
+}
+
+// PutHash and Append applied once each, across retries
+// and a failover.
+func TestAtMostOnce(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "atmostonce"
+  vshost := port(tag+"v", 1)
+  vs := viewservice.StartServer(vshost)
+  time.Sleep(time.Second)
+  vck := viewservice.MakeClerk("", vshost)
+
+  s1 := StartServer(vshost, port(tag, 1))
+  time.Sleep(viewservice.PingInterval * viewservice.DeadPings * 2)
+  s2 := StartServer(vshost, port(tag, 2))
+  for iter := 0; iter < viewservice.DeadPings * 3; iter++ {
+    s1.mu.Lock()
+    backup := s1.view.Backup
+    s1.mu.Unlock()
+    if backup == s2.me {
+      break
+    }
+    time.Sleep(viewservice.PingInterval)
+  }
+  if v, _ := vck.Get(); v.Primary != s1.me || v.Backup != s2.me {
+    t.Fatalf("view never formed")
+  }
+
+  fmt.Printf("Test: At-most-once PutHash with unreliable servers ...\n")
+
+  s1.unreliable = true
+  s2.unreliable = true
+  ck := MakeClerk(vshost, "")
+  prev := ""
+  for i := 0; i < 50; i++ {
+    v := strconv.Itoa(i)
+    pv := ck.PutHash("h", v)
+    if pv != prev {
+      t.Fatalf("PutHash(h, %v) returned %v, expected %v", v, pv, prev)
+    }
+    prev = strconv.Itoa(int(hash(prev + v)))
+  }
+  for i := 0; i < 20; i++ {
+    ck.Append("a", "x")
+  }
+  s1.unreliable = false
+  s2.unreliable = false
+  check(ck, "h", prev)
+  check(ck, "a", "xxxxxxxxxxxxxxxxxxxx")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: A Put retried at the new primary ...\n")
+
+  // a Put whose reply got lost
+  args := &PutArgs{ "a", "y", OpAppend, nrand(), 1 }
+  var reply PutReply
+  for call(s1.me, "PBServer.Put", args, &reply) == false || reply.Err != OK {
+    time.Sleep(viewservice.PingInterval)
+  }
+
+  s1.kill()
+  for iter := 0; iter < viewservice.DeadPings * 3; iter++ {
+    if vck.Primary() == s2.me {
+      break
+    }
+    time.Sleep(viewservice.PingInterval)
+  }
+  if vck.Primary() != s2.me {
+    t.Fatalf("backup never switched to primary")
+  }
+
+  var reply2 PutReply
+  for call(s2.me, "PBServer.Put", args, &reply2) == false || reply2.Err != OK {
+    time.Sleep(viewservice.PingInterval)
+  }
+  if reply2.PreviousValue != reply.PreviousValue {
+    t.Fatalf("retried Append replied %v, first reply was %v", reply2.PreviousValue, reply.PreviousValue)
+  }
+  check(ck, "a", "xxxxxxxxxxxxxxxxxxxxy")
+
+  fmt.Printf("  ... Passed\n")
+
+  s1.kill()
+  s2.kill()
+  vs.Kill()
+}
+
+// two backups: the values survive the primary and then
+// the next primary failing.
+func TestTwoBackups(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "twobackups"
+  vshost := port(tag+"v", 1)
+  vs := viewservice.StartServerBackups(vshost, 2)
+  time.Sleep(time.Second)
+  vck := viewservice.MakeClerk("", vshost)
+
+  fmt.Printf("Test: Puts reach both backups ...\n")
+
+  s1 := StartServer(vshost, port(tag, 1))
+  time.Sleep(viewservice.PingInterval * viewservice.DeadPings * 2)
+  ck := MakeClerk(vshost, "")
+  ck.Put("a", "aa")
+  s2 := StartServer(vshost, port(tag, 2))
+  s3 := StartServer(vshost, port(tag, 3))
+  for iter := 0; iter < viewservice.DeadPings * 3; iter++ {
+    s1.mu.Lock()
+    n := len(s1.view.Backups)
+    s1.mu.Unlock()
+    if n == 2 {
+      break
+    }
+    time.Sleep(viewservice.PingInterval)
+  }
+  v, _ := vck.Get()
+  if v.Primary != s1.me || len(v.Backups) != 2 {
+    t.Fatalf("view with two backups never formed")
+  }
+  ck.Put("b", "bb")
+  ck.Append("a", "x")
+
+  for _, s := range []*PBServer{ s2, s3 } {
+    s.mu.Lock()
+    a, b := s.values["a"], s.values["b"]
+    s.mu.Unlock()
+    if a != "aax" || b != "bb" {
+      t.Fatalf("backup %v has a=%v b=%v", s.me, a, b)
+    }
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Primary fails, then the next one ...\n")
+
+  s1.kill()
+  for iter := 0; iter < viewservice.DeadPings * 3; iter++ {
+    if vck.Primary() == v.Backups[0] {
+      break
+    }
+    time.Sleep(viewservice.PingInterval)
+  }
+  check(ck, "a", "aax")
+  ck.Put("c", "cc")
+
+  v, _ = vck.Get()
+  if v.Primary == s2.me {
+    s2.kill()
+  } else {
+    s3.kill()
+  }
+  for iter := 0; iter < viewservice.DeadPings * 3; iter++ {
+    if p := vck.Primary(); p != v.Primary {
+      break
+    }
+    time.Sleep(viewservice.PingInterval)
+  }
+  if p := vck.Primary(); p == v.Primary || p == s1.me {
+    t.Fatalf("last backup never became primary")
+  }
+  check(ck, "a", "aax")
+  check(ck, "b", "bb")
+  check(ck, "c", "cc")
+
+  fmt.Printf("  ... Passed\n")
+
+  s1.kill()
+  s2.kill()
+  s3.kill()
+  vs.Kill()
+}
+
+//
+// a Put whose forward to the backup is slow does not hold
+// up Gets, and the next Put of the same key waits for it.
+//
+func TestSlowForward(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "slowforward"
+  vshost := port(tag+"v", 1)
+  vs := viewservice.StartServer(vshost)
+  time.Sleep(time.Second)
+  vck := viewservice.MakeClerk("", vshost)
+
+  s1 := StartServer(vshost, port(tag, 1))
+  time.Sleep(time.Second)
+  s2 := StartServer(vshost, port(tag, 2))
+  for i := 0; i < viewservice.DeadPings * 3; i++ {
+    v, _ := vck.Get()
+    if v.Primary != "" && v.Backup != "" {
+      break
+    }
+    time.Sleep(viewservice.PingInterval)
+  }
+  time.Sleep(time.Second) // wait for backup initializion
+  v1, _ := vck.Get()
+  if v1.Primary != s1.me || v1.Backup != s2.me {
+    t.Fatalf("wrong primary or backup")
+  }
+
+  ck := MakeClerk(vshost, "")
+  ck.Put("a", "aa")
+  ck.Put("b", "bb")
+
+  fmt.Printf("Test: Get() during a slow forward ...\n")
+
+  // the backup cannot take the forward until unlocked
+  s2.mu.Lock()
+  done := make(chan bool, 2)
+  go func() {
+    MakeClerk(vshost, "").Append("a", "x")
+    done <- true
+  }()
+  time.Sleep(viewservice.PingInterval / 2)
+  go func() {
+    MakeClerk(vshost, "").Append("a", "y")
+    done <- true
+  }()
+  time.Sleep(viewservice.PingInterval / 2)
+
+  got := make(chan bool, 1)
+  go func() {
+    check(ck, "b", "bb")
+    got <- true
+  }()
+  select {
+  case <-got:
+  case <-time.After(viewservice.PingInterval):
+    s2.mu.Unlock()
+    t.Fatalf("Get() held up by a forward")
+  }
+  select {
+  case <-done:
+    t.Fatalf("Put() done before the backup had it")
+  default:
+  }
+  s2.mu.Unlock()
+  <-done
+  <-done
+
+  s1.mu.Lock()
+  a1 := s1.values["a"]
+  s1.mu.Unlock()
+  s2.mu.Lock()
+  a2 := s2.values["a"]
+  s2.mu.Unlock()
+  if a1 != "aaxy" || a2 != a1 {
+    t.Fatalf("primary has a=%v, backup a=%v; wanted aaxy", a1, a2)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  s1.kill()
+  s2.kill()
+  time.Sleep(viewservice.PingInterval * 2)
+  vs.Kill()
+}
@@ -0,0 +1,213 @@
+package pbservice
+
+//
+// Copying the primary's values to a new backup.
+//
+// When the view names a backup the primary has not copied
+// its values to (every backup, for a primary that was just
+// promoted), the primary takes the
+// sorted list of its keys and sends their values to the backup
+// in chunks of about ChunkBytes, one Transfer RPC at a time,
+// without holding pb.mu during the RPC. Each chunk says where
+// in the list it starts (From) and ends (To); the backup keeps
+// the position it has reached, and answers a chunk that does
+// not start there with ErrOutOfOrder and its position, so the
+// primary goes on from there after a lost reply, and starts
+// over for a backup that restarted.
+//
+// Puts go on meanwhile. A Put of a key whose chunk has been
+// taken, or that is not in the list, is forwarded to the new
+// backup; one of a key still to be sent is not, since its chunk
+// will carry the new value. The backup ignores the values in
+// chunks for keys it has had forwarded Puts for, which are
+// newer. The chunk of a key waits while a Put of it is being
+// forwarded, so that the Put goes to the new backup exactly if
+// its chunk was taken before; a transfer that starts meanwhile
+// lists the keys such Puts create. Once the last chunk is in
+// the backup acknowledges the view the transfer is named by to
+// the viewservice, which does not promote it before. Each
+// backup has its own transfer, and keeps it for as long as it
+// stays a backup.
+//
+// The duplicate table goes with the last chunk. The entries of
+// Puts after that come with their forwards, and the backup
+// keeps the later of two entries for a clerk.
+//
+// A transfer is named by the view number that made the backup;
+// forwarded Puts carry it too, and the backup starts afresh
+// when it sees a new one.
+//
+
+import "viewservice"
+import "fmt"
+import "sort"
+import "time"
+
+const (
+  // about how much data one Transfer carries
+  ChunkBytes = 64 * 1024
+)
+
+type transfer struct {
+  backup string
+  viewnum uint
+  keys []string // sorted, as of the start
+  // the keys whose chunk has not been taken yet
+  pending map[string]bool
+  done bool
+}
+
+//
+// begin copying to backup, one of the backups of view.
+// hold pb.mu before call this func
+//
+func (pb *PBServer) StartTransfer(view viewservice.View, backup string) *transfer {
+  x := &transfer{}
+  x.backup = backup
+  x.viewnum = view.Viewnum
+  x.pending = make(map[string]bool)
+  for key := range pb.values {
+    x.keys = append(x.keys, key)
+    x.pending[key] = true
+  }
+  for key := range pb.busy {
+    if _, ok := pb.values[key]; !ok {
+      x.keys = append(x.keys, key)
+      x.pending[key] = true
+    }
+  }
+  sort.Strings(x.keys)
+  pb.xfers[backup] = x
+  fmt.Printf("%s: transfer %d keys to backup '%s' for view %d\n", pb.me, len(x.keys), x.backup, x.viewnum)
+  go pb.RunTransfer(x)
+  return x
+}
+
+func (pb *PBServer) RunTransfer(x *transfer) {
+  next := 0
+  for !pb.dead {
+    pb.mu.Lock()
+    for next < len(x.keys) && pb.busy[x.keys[next]] {
+      pb.idle.Wait()
+    }
+    if pb.xfers[x.backup] != x {
+      // no longer a backup
+      pb.mu.Unlock()
+      return
+    }
+    args := &TransferArgs{ Xfer: x.viewnum, From: next }
+    size := 0
+    for next < len(x.keys) && size < ChunkBytes && !pb.busy[x.keys[next]] {
+      key := x.keys[next]
+      delete(x.pending, key)
+      if value, ok := pb.values[key]; ok {
+        // not there if its first Put failed
+        args.Keys = append(args.Keys, key)
+        args.Values = append(args.Values, value)
+        size += len(key) + len(value)
+      }
+      next++
+    }
+    args.To = next
+    args.Last = next == len(x.keys)
+    if args.Last {
+      // the Puts after this are all forwarded, and carry
+      // their own entries
+      args.Dups = make(map[int64]DupEntry)
+      for client, e := range pb.dups {
+        args.Dups[client] = e
+      }
+    }
+    pb.mu.Unlock()
+
+    var reply TransferReply
+    ok := call(x.backup, "PBServer.Transfer", args, &reply)
+    if ok && reply.Err == ErrOutOfOrder {
+      next = reply.Cursor
+    } else if !ok || reply.Err != OK {
+      fmt.Printf("%s: Transfer to backup '%s' at %d failed\n", pb.me, x.backup, args.From)
+      next = args.From
+      time.Sleep(viewservice.PingInterval)
+      continue
+    }
+    if next == len(x.keys) {
+      pb.mu.Lock()
+      x.done = true
+      pb.mu.Unlock()
+      fmt.Printf("%s: transfer to backup '%s' done\n", pb.me, x.backup)
+      return
+    }
+  }
+}
+
+//
+// the backups a Put of key is to be forwarded to, with the
+// transfer that made each of them.
+// hold pb.mu before call this func
+//
+func (pb *PBServer) ForwardTo(key string) []*transfer {
+  xs := []*transfer{}
+  for _, backup := range pb.backups {
+    if x := pb.xfers[backup]; x != nil && !x.pending[key] {
+      xs = append(xs, x)
+    }
+  }
+  return xs
+}
+
+//
+// the backup's state for transfer xfer, made afresh if
+// it is a new one.
+// hold pb.mu before call this func
+//
+func (pb *PBServer) RecvStart(xfer uint) {
+  if pb.recvXfer == xfer {
+    return
+  }
+  pb.recvXfer = xfer
+  pb.recvCursor = 0
+  pb.recvDone = false
+  pb.values = make(map[string]string)
+  pb.forwarded = make(map[string]bool)
+  pb.dups = make(map[int64]DupEntry)
+}
+
+//
+// keep e as client's entry unless a later one is there.
+// hold pb.mu before call this func
+//
+func (pb *PBServer) MergeDup(client int64, e DupEntry) {
+  if last, ok := pb.dups[client]; !ok || last.Seq < e.Seq {
+    pb.dups[client] = e
+  }
+}
+
+func (pb *PBServer) Transfer(args *TransferArgs, reply *TransferReply) error {
+  pb.mu.Lock()
+  defer pb.mu.Unlock()
+
+  if !pb.view.IsBackup(pb.me) {
+    fmt.Printf("Transfer: I'm not backup server: '%s'\n", pb.me)
+    reply.Err = ErrWrongServer
+    return nil
+  }
+
+  pb.RecvStart(args.Xfer)
+  if args.From != pb.recvCursor {
+    reply.Err = ErrOutOfOrder
+    reply.Cursor = pb.recvCursor
+    return nil
+  }
+  for i, key := range args.Keys {
+    if !pb.forwarded[key] {
+      pb.values[key] = args.Values[i]
+    }
+  }
+  for client, e := range args.Dups {
+    pb.MergeDup(client, e)
+  }
+  pb.recvCursor = args.To
+  pb.recvDone = args.Last
+  reply.Err = OK
+  return nil
+}
@@ -4,20 +4,37 @@ import "shardmaster"
 import "net/rpc"
 import "time"
 import "sync"
+import "sort"
+import "crypto/rand"
+import "math/big"
 // import "fmt"
 
+// how long a Clerk waits for a new config before it
+// tries the group it knows again
+const RefreshWait = 100 * time.Millisecond
+
 type Clerk struct {
   mu sync.Mutex // one RPC at a time
   sm *shardmaster.Clerk
   config shardmaster.Config
   // You'll have to modify Clerk.
+  clientId int64
+  // the seq of the latest request; servers remember the
+  // reply to it, so a retry gets the original result
+  seq int64
 }
 
+func nrand() int64 {
+  max := big.NewInt(int64(1) << 62)
+  bigx, _ := rand.Int(rand.Reader, max)
+  return bigx.Int64() + 1
+}
 
 func MakeClerk(shardmasters []string) *Clerk {
   ck := new(Clerk)
   ck.sm = shardmaster.MakeClerk(shardmasters)
   // You'll have to modify MakeClerk.
+  ck.clientId = nrand()
   return ck
 }
 
@@ -53,17 +70,25 @@ func call(srv string, rpcname string,
 }
 
 //
-// which shard is a key in?
-// please use this function,
-// and please do not change it.
+// wait up to RefreshWait for a config newer than ck.config.
+// hold ck.mu before call this func
 //
-func key2shard(key string) int {
-  shard := 0
-  if len(key) > 0 {
-    shard = int(key[0])
+func (ck *Clerk) refresh() {
+  if c := ck.sm.Watch(ck.config.Num, RefreshWait); c.Num > ck.config.Num {
+    ck.config = c
   }
-  shard %= shardmaster.NShards
-  return shard
+}
+
+//
+// the group that serves key in config, or 0 (no group)
+// for a config that has no shards, e.g. before the first
+// Query().
+//
+func owner(config *shardmaster.Config, key string) int64 {
+  if len(config.Shards) == 0 {
+    return 0
+  }
+  return config.Shards[config.ShardOf(key)]
 }
 
 //
@@ -75,13 +100,21 @@ func (ck *Clerk) Get(key string) string {
   ck.mu.Lock()
   defer ck.mu.Unlock()
 
+  value, _ := ck.get(key)
+  return value
+}
+
+//
+// Get(), and the version of the key.
+// hold ck.mu before call this func
+//
+func (ck *Clerk) get(key string) (string, int64) {
 
   // You'll have to modify Get().
+  ck.seq++
 
   for {
-    shard := key2shard(key)
-
-    gid := ck.config.Shards[shard]
+    gid := owner(&ck.config, key)
 
     servers, ok := ck.config.Groups[gid]
 
@@ -90,20 +123,23 @@ func (ck *Clerk) Get(key string) string {
       for _, srv := range servers {
         args := &GetArgs{}
         args.Key = key
+        args.ClientId = ck.clientId
+        args.Seq = ck.seq
         var reply GetReply
         ok := call(srv, "ShardKV.Get", args, &reply)
         if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
-          return reply.Value
+          return reply.Value, reply.Version
+        }
+        if ok && (reply.Err == ErrLocked || reply.Err == ErrWrongGroup) {
+          break
         }
       }
     }
 
-    time.Sleep(100 * time.Millisecond)
-
-    // ask master for a new configuration.
-    ck.config = ck.sm.Query(-1)
+    // wait for the master to have a new configuration.
+    ck.refresh()
   }
-  return ""
+  return "", 0
 }
 
 func (ck *Clerk) Put(key string, value string) {
@@ -112,11 +148,10 @@ func (ck *Clerk) Put(key string, value string) {
 
 
   // You'll have to modify Put().
+  ck.seq++
 
   for {
-    shard := key2shard(key)
-
-    gid := ck.config.Shards[shard]
+    gid := owner(&ck.config, key)
 
     servers, ok := ck.config.Groups[gid]
 
@@ -127,17 +162,197 @@ func (ck *Clerk) Put(key string, value string) {
         args := &PutArgs{}
         args.Key = key
         args.Value = value
+        args.ClientId = ck.clientId
+        args.Seq = ck.seq
         var reply PutReply
         ok := call(srv, "ShardKV.Put", args, &reply)
         if ok && reply.Err == OK {
           return
         }
+        if ok && (reply.Err == ErrLocked || reply.Err == ErrWrongGroup) {
+          break
+        }
       }
     }
 
+    // wait for the master to have a new configuration.
+    ck.refresh()
+  }
+}
+
+//
+// a transaction; see txn.go for how it commits.
+//
+type Txn struct {
+  ck *Clerk
+  id int64
+  // the version of each key read, and the values to write
+  reads map[string]int64
+  writes map[string]string
+}
+
+func (ck *Clerk) Begin() *Txn {
+  tx := &Txn{}
+  tx.ck = ck
+  tx.id = nrand()
+  tx.reads = make(map[string]int64)
+  tx.writes = make(map[string]string)
+  return tx
+}
+
+//
+// read a key as of the transaction: its own writes, or
+// the current value, which Commit checks is unchanged.
+//
+func (tx *Txn) Get(key string) string {
+  if value, ok := tx.writes[key]; ok {
+    return value
+  }
+
+  tx.ck.mu.Lock()
+  defer tx.ck.mu.Unlock()
+  value, version := tx.ck.get(key)
+  if _, ok := tx.reads[key]; !ok {
+    tx.reads[key] = version
+  }
+  return value
+}
+
+//
+// buffer a write until Commit.
+//
+func (tx *Txn) Put(key string, value string) {
+  tx.writes[key] = value
+}
+
+//
+// returns false if the transaction aborted, e.g. because
+// a key it read has changed or is locked by another
+// transaction; the caller may run it again.
+//
+func (tx *Txn) Commit() bool {
+  ck := tx.ck
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+
+  for {
+    vote, committed := tx.try()
+    if vote != ErrWrongGroup {
+      return committed
+    }
+    // a group did not serve some of the keys; abort, and
+    // try again as a new transaction, which the versions
+    // read keep equivalent
+    ck.refresh()
+    tx.id = nrand()
+  }
+}
+
+//
+// one attempt to commit under ck.config. returns the first
+// vote that was not yes, and whether the transaction committed.
+// hold ck.mu before call this func
+//
+func (tx *Txn) try() (Err, bool) {
+  ck := tx.ck
+
+  // split the transaction among the groups
+  var parts map[int64]*PrepareArgs
+  for {
+    parts = make(map[int64]*PrepareArgs)
+    ok := true
+    part := func(key string) *PrepareArgs {
+      gid := owner(&ck.config, key)
+      if _, exists := ck.config.Groups[gid]; !exists {
+        ok = false
+      }
+      if parts[gid] == nil {
+        parts[gid] = &PrepareArgs{ TxnId: tx.id,
+          Reads: make(map[string]int64), Writes: make(map[string]string) }
+      }
+      return parts[gid]
+    }
+    for key, version := range tx.reads {
+      part(key).Reads[key] = version
+    }
+    for key, value := range tx.writes {
+      part(key).Writes[key] = value
+    }
+    if ok {
+      break
+    }
+    ck.refresh()
+  }
+  if len(parts) == 0 {
+    return OK, true
+  }
+
+  var gids []int64
+  for gid := range parts {
+    gids = append(gids, gid)
+  }
+  sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+  coord := gids[0]
+  servers := make(map[int64][]string)
+  for _, gid := range gids {
+    servers[gid] = ck.config.Groups[gid]
+  }
+
+  var vote Err = OK
+  for _, gid := range gids {
+    args := parts[gid]
+    args.CoordServers = servers[coord]
+    vote = ck.prepare(servers[gid], args)
+    if vote != OK {
+      break
+    }
+  }
+
+  // the coordinator's answer is the outcome
+  committed := ck.decide(servers[coord], tx.id, vote == OK) == OK
+  for _, gid := range gids[1:] {
+    ck.decide(servers[gid], tx.id, committed)
+  }
+  return vote, committed
+}
+
+//
+// returns the group's vote, or ErrWrongGroup.
+// hold ck.mu before call this func
+//
+func (ck *Clerk) prepare(servers []string, args *PrepareArgs) Err {
+  ck.seq++
+  args.ClientId = ck.clientId
+  args.Seq = ck.seq
+
+  for {
+    for _, srv := range servers {
+      var reply PrepareReply
+      ok := call(srv, "ShardKV.Prepare", args, &reply)
+      if ok && (reply.Err == OK || reply.Err == ErrAborted || reply.Err == ErrWrongGroup) {
+        return reply.Err
+      }
+    }
     time.Sleep(100 * time.Millisecond)
+  }
+}
+
+//
+// returns OK if the transaction committed at the group.
+// hold ck.mu before call this func
+//
+func (ck *Clerk) decide(servers []string, txnId int64, commit bool) Err {
+  ck.seq++
+  args := &DecideArgs{ txnId, commit, ck.clientId, ck.seq }
 
-    // ask master for a new configuration.
-    ck.config = ck.sm.Query(-1)
+  for {
+    for _, srv := range servers {
+      var reply DecideReply
+      ok := call(srv, "ShardKV.Decide", args, &reply)
+      if ok && (reply.Err == OK || reply.Err == ErrAborted) {
+        return reply.Err
+      }
+    }
+    time.Sleep(100 * time.Millisecond)
   }
 }
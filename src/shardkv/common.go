@@ -13,12 +13,21 @@ const (
   OK = "OK"
   ErrNoKey = "ErrNoKey"
   ErrWrongGroup = "ErrWrongGroup"
+  // the key is locked by a prepared transaction
+  ErrLocked = "ErrLocked"
+  ErrAborted = "ErrAborted"
+  // the previous owner has not handed the shard off yet
+  ErrNotReady = "ErrNotReady"
+  // the server has not applied the instance asked for
+  ErrBehind = "ErrBehind"
 )
 type Err string
 
 type PutArgs struct {
   Key string
   Value string
+  ClientId int64
+  Seq int64
 }
 
 type PutReply struct {
@@ -27,9 +36,78 @@ type PutReply struct {
 
 type GetArgs struct {
   Key string
+  ClientId int64
+  Seq int64
 }
 
 type GetReply struct {
   Err Err
   Value string
+  // how many times the key was written
+  Version int64
+}
+
+//
+// the part of a transaction in one group's shards.
+//
+type PrepareArgs struct {
+  TxnId int64
+  // the version of each key read
+  Reads map[string]int64
+  Writes map[string]string
+  // the servers of the coordinator group
+  CoordServers []string
+  ClientId int64
+  Seq int64
+}
+
+type PrepareReply struct {
+  // OK for a yes vote, ErrAborted for a no
+  Err Err
+}
+
+type DecideArgs struct {
+  TxnId int64
+  Commit bool
+  ClientId int64
+  Seq int64
+}
+
+type DecideReply struct {
+  // OK if the transaction committed, ErrAborted if not
+  Err Err
+}
+
+type TxnStatusArgs struct {
+  TxnId int64
+}
+
+type TxnStatusReply struct {
+  Err Err
+  Committed bool
+}
+
+type TransferArgs struct {
+  // the config that moved Shard away from the callee
+  ConfigNum int
+  Shard int
+}
+
+type TransferReply struct {
+  Err Err
+  Data map[string]string
+  Versions map[string]int64
+  Dups map[int64]DupEntry
+}
+
+// between the servers of a group, see FetchState()
+type StateArgs struct {
+  // the caller needs the state with instances <= Seq applied
+  Seq int
+}
+
+type StateReply struct {
+  Err Err
+  // a gob-encoded kvSnapshot
+  State []byte
 }
@@ -0,0 +1,291 @@
+package shardkv
+
+//
+// Reconfiguration.
+//
+// tick() moves the group to the next configuration, one
+// number at a time, through an OpReconfig in the group's log.
+// Applying it stops serving the shards the group loses, and
+// freezes a copy of them, with the duplicate table, under
+// the new config's number. The shards it gains from another
+// group are then waiting: tick() pulls each one from its
+// previous owner with Transfer(), which the owner answers
+// once it has applied the same config, and installs it with
+// an OpInstall. The group serves a shard it gains once it is
+// installed, and goes on to the next config only when no
+// shard is waiting.
+//
+// tick() reports each config the group applies to the
+// shardmaster, which keeps the configs from there on. A group
+// that holds no shards may find the configs after its own
+// dropped; it took no part in them, so it skips to the oldest
+// one kept.
+//
+// Split and Merge change the shards' key ranges between two
+// configs, so what moves is worked out per key: the keys of
+// an old shard that go to other groups are frozen under the
+// old shard's index, a group waits for every old shard that
+// held keys it now serves, and installs only those keys.
+//
+// Shards locked by a prepared transaction are not handed off;
+// the OpReconfig is refused until the transaction is decided.
+//
+// The frozen copies are kept until the shardmaster drops their
+// config. It keeps every config from the lowest one a group has
+// reported, and a group reports a config only once it has
+// installed the shards of the one before it; so by then every
+// group that gained keys from a copy has them. tick() asks for
+// the oldest config kept, and drops the older copies with an
+// OpDropOutgoing.
+//
+
+import "log"
+import "shardmaster"
+
+type ShardState struct {
+  Data map[string]string
+  Versions map[string]int64
+  Dups map[int64]DupEntry
+}
+
+// hold kv.mu before call this func
+func (kv *ShardKV) ShardOf(key string) int {
+  return kv.config.ShardOf(key)
+}
+
+//
+// does the group serve shard of kv.config? not while an
+// old shard with keys in its range is still waiting.
+// hold kv.mu before call this func
+//
+func (kv *ShardKV) Serves(shard int) bool {
+  if shard >= len(kv.config.Shards) || kv.config.Shards[shard] != kv.gid {
+    return false
+  }
+  for old := range kv.waiting {
+    if kv.config.Overlaps(shard, &kv.prevConfig, old) {
+      return false
+    }
+  }
+  return true
+}
+
+//
+// does the group own any shard of config?
+//
+func (kv *ShardKV) Owns(config *shardmaster.Config) bool {
+  for _, gid := range config.Shards {
+    if gid == kv.gid {
+      return true
+    }
+  }
+  return false
+}
+
+//
+// does the group serve part of old shard of from in to?
+//
+func (kv *ShardKV) Gains(from *shardmaster.Config, old int, to *shardmaster.Config) bool {
+  for shard, gid := range to.Shards {
+    if gid == kv.gid && to.Overlaps(shard, from, old) {
+      return true
+    }
+  }
+  return false
+}
+
+// hold kv.mu before call this func
+func (kv *ShardKV) ApplyReconfig(config shardmaster.Config) Result {
+  if config.Num <= kv.config.Num || len(kv.waiting) > 0 {
+    return Result{ ErrNotReady, "", 0 }
+  }
+  if config.Num > kv.config.Num + 1 && (kv.Owns(&kv.config) || kv.Owns(&config)) {
+    // the configs skipped are dropped by the shardmaster,
+    // which keeps those of groups that hold shards
+    log.Printf("[skv][%d][%d] config %d: cannot skip from config %d", kv.gid, kv.me, config.Num, kv.config.Num)
+    return Result{ ErrNotReady, "", 0 }
+  }
+
+  // the old shards that hand keys to other groups. a
+  // shard that is split may lose only part of its keys.
+  var lost []int
+  for shard, gid := range kv.config.Shards {
+    if gid != kv.gid {
+      continue
+    }
+    for s, g := range config.Shards {
+      if g != kv.gid && config.Overlaps(s, &kv.config, shard) {
+        lost = append(lost, shard)
+        break
+      }
+    }
+  }
+  leaves := func(key string) bool {
+    return owner(&kv.config, key) == kv.gid && owner(&config, key) != kv.gid
+  }
+  for key := range kv.locks {
+    if leaves(key) {
+      log.Printf("[skv][%d][%d] config %d: key %s is locked", kv.gid, kv.me, config.Num, key)
+      return Result{ ErrLocked, "", 0 }
+    }
+  }
+
+  out := make(map[int]*ShardState)
+  for _, shard := range lost {
+    out[shard] = &ShardState{ make(map[string]string), make(map[string]int64), kv.CopyDups() }
+  }
+  for key, value := range kv.data {
+    if leaves(key) {
+      out[kv.ShardOf(key)].Data[key] = value
+      delete(kv.data, key)
+    }
+  }
+  for key, version := range kv.versions {
+    if leaves(key) {
+      out[kv.ShardOf(key)].Versions[key] = version
+      delete(kv.versions, key)
+    }
+  }
+  if len(out) > 0 {
+    kv.outgoing[config.Num] = out
+  }
+
+  for old, prev := range kv.config.Shards {
+    if prev != kv.gid && prev != 0 && kv.Gains(&kv.config, old, &config) {
+      kv.waiting[old] = true
+    }
+  }
+
+  kv.prevConfig = kv.config
+  kv.config = config
+  log.Printf("[skv][%d][%d] config %d: lost %v, waiting for %v", kv.gid, kv.me, config.Num, lost, kv.waiting)
+  return Result{ OK, "", 0 }
+}
+
+// hold kv.mu before call this func
+func (kv *ShardKV) ApplyInstall(op Op) Result {
+  if op.Config.Num != kv.config.Num || !kv.waiting[op.Shard] {
+    return Result{ OK, "", 0 }
+  }
+
+  // the old shard may also hold keys for other groups
+  for key, value := range op.Data {
+    if owner(&kv.config, key) == kv.gid {
+      kv.data[key] = value
+    }
+  }
+  for key, version := range op.Versions {
+    if owner(&kv.config, key) == kv.gid {
+      kv.versions[key] = version
+    }
+  }
+  for client, e := range op.Dups {
+    if last, ok := kv.dups[client]; !ok || last.Seq < e.Seq {
+      kv.dups[client] = e
+    }
+  }
+  delete(kv.waiting, op.Shard)
+  log.Printf("[skv][%d][%d] config %d: installed shard %d", kv.gid, kv.me, kv.config.Num, op.Shard)
+  return Result{ OK, "", 0 }
+}
+
+//
+// forget the shards frozen under configs older than oldest,
+// the oldest config the shardmaster keeps.
+// hold kv.mu before call this func
+//
+func (kv *ShardKV) ApplyDropOutgoing(oldest shardmaster.Config) Result {
+  for num := range kv.outgoing {
+    if num < oldest.Num {
+      log.Printf("[skv][%d][%d] config %d: dropped the shards handed off", kv.gid, kv.me, num)
+      delete(kv.outgoing, num)
+    }
+  }
+  return Result{ OK, "", 0 }
+}
+
+//
+// drop the frozen shards that no group needs any more.
+//
+func (kv *ShardKV) DropOutgoing() {
+  kv.mu.Lock()
+  first := -1
+  for num := range kv.outgoing {
+    if first < 0 || num < first {
+      first = num
+    }
+  }
+  kv.mu.Unlock()
+
+  if first < 0 {
+    return
+  }
+  oldest, err := kv.sm.QueryErr(first)
+  if err == shardmaster.ErrCompacted {
+    kv.AppendOp(Op{ Seq: nrand(), OpType: OpDropOutgoing, Config: oldest })
+  }
+}
+
+// hold kv.mu before call this func
+func (kv *ShardKV) CopyDups() map[int64]DupEntry {
+  dups := make(map[int64]DupEntry)
+  for client, e := range kv.dups {
+    dups[client] = e
+  }
+  return dups
+}
+
+//
+// fetch the waiting shards from their previous owners.
+//
+func (kv *ShardKV) PullShards() {
+  kv.mu.Lock()
+  config := kv.config
+  prev := kv.prevConfig
+  var shards []int
+  for shard := range kv.waiting {
+    shards = append(shards, shard)
+  }
+  kv.mu.Unlock()
+
+  // the waiting shards are numbered as in prev
+  for _, shard := range shards {
+    servers := prev.Groups[prev.Shards[shard]]
+    for _, srv := range servers {
+      args := &TransferArgs{ config.Num, shard }
+      var reply TransferReply
+      ok := call(srv, "ShardKV.Transfer", args, &reply)
+      if ok && reply.Err == OK {
+        kv.AppendOp(Op{ Seq: nrand(), OpType: OpInstall, Config: config, Shard: shard,
+          Data: reply.Data, Versions: reply.Versions, Dups: reply.Dups })
+        break
+      }
+    }
+  }
+}
+
+func (kv *ShardKV) Transfer(args *TransferArgs, reply *TransferReply) error {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+
+  st, ok := kv.outgoing[args.ConfigNum][args.Shard]
+  if !ok {
+    reply.Err = ErrNotReady
+    return nil
+  }
+  // the reply is encoded after kv.mu is released
+  reply.Err = OK
+  reply.Data = make(map[string]string)
+  for key, value := range st.Data {
+    reply.Data[key] = value
+  }
+  reply.Versions = make(map[string]int64)
+  for key, version := range st.Versions {
+    reply.Versions[key] = version
+  }
+  reply.Dups = make(map[int64]DupEntry)
+  for client, e := range st.Dups {
+    reply.Dups[client] = e
+  }
+  return nil
+}
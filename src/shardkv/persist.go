@@ -0,0 +1,234 @@
+package shardkv
+
+//
+// Durable state, so a whole group can restart.
+//
+// A server started with a directory keeps its Paxos acceptor
+// state in dir/paxos, and its own state in two files. Each
+// decided batch the background worker applies is appended to
+// the write-ahead log, and synced, before the server calls
+// Done() for it; so an instance Paxos forgets is always in the
+// log. Every SnapshotEvery instances the whole state is written
+// to the snapshot file (to a temporary file first, and renamed
+// over it), and the log is emptied.
+//
+// On restart the server loads the snapshot, applies the
+// records of the log after it, and then goes on from the next
+// instance through Paxos as usual. A torn record at the tail
+// of the log is cut off; records the snapshot already holds
+// are skipped.
+//
+
+import "os"
+import "io"
+import "bufio"
+import "bytes"
+import "encoding/gob"
+import "encoding/binary"
+import "path/filepath"
+import "log"
+import "time"
+import "paxos"
+import "shardmaster"
+
+const (
+  SnapshotFile = "snapshot"
+  LogFile = "wal.log"
+  // instances applied between snapshots
+  SnapshotEvery = 50
+)
+
+type walRecord struct {
+  Seq int
+  Batch paxos.Batch
+}
+
+type kvSnapshot struct {
+  Applied int
+  Data map[string]string
+  Versions map[string]int64
+  Dups map[int64]DupEntry
+  Prepared map[int64]*Prepared
+  Locks map[string]int64
+  Outcomes map[int64]Outcome
+  Config shardmaster.Config
+  PrevConfig shardmaster.Config
+  Waiting map[int]bool
+  Outgoing map[int]map[int]*ShardState
+}
+
+func writeRecord(w io.Writer, rec *walRecord) error {
+  var buf bytes.Buffer
+  if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+    return err
+  }
+  var hdr [4]byte
+  binary.LittleEndian.PutUint32(hdr[:], uint32(buf.Len()))
+  _, err := w.Write(append(hdr[:], buf.Bytes()...))
+  return err
+}
+
+// returns the records and the length of the valid prefix of r.
+func readRecords(r io.Reader) ([]walRecord, int64) {
+  var recs []walRecord
+  var good int64 = 0
+  br := bufio.NewReader(r)
+  for {
+    var hdr [4]byte
+    if _, err := io.ReadFull(br, hdr[:]); err != nil {
+      break
+    }
+    body := make([]byte, binary.LittleEndian.Uint32(hdr[:]))
+    if _, err := io.ReadFull(br, body); err != nil {
+      break
+    }
+    var rec walRecord
+    if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&rec); err != nil {
+      break
+    }
+    recs = append(recs, rec)
+    good += int64(len(hdr) + len(body))
+  }
+  return recs, good
+}
+
+//
+// load the snapshot and the log in kv.dir, and open the log
+// for appending. called by StartPersistentServer() before the
+// server serves RPCs or applies anything.
+//
+func (kv *ShardKV) Recover() {
+  if err := os.MkdirAll(kv.dir, 0777); err != nil {
+    log.Fatal("shardkv storage: ", err)
+  }
+
+  if f, err := os.Open(filepath.Join(kv.dir, SnapshotFile)); err == nil {
+    var snap kvSnapshot
+    err = gob.NewDecoder(bufio.NewReader(f)).Decode(&snap)
+    f.Close()
+    if err != nil {
+      log.Fatal("shardkv storage: ", err)
+    }
+    kv.mu.Lock()
+    kv.Restore(&snap)
+    kv.mu.Unlock()
+  }
+
+  f, err := os.OpenFile(filepath.Join(kv.dir, LogFile), os.O_RDWR|os.O_CREATE, 0666)
+  if err != nil {
+    log.Fatal("shardkv storage: ", err)
+  }
+  recs, good := readRecords(f)
+  replayed := 0
+  for i := range recs {
+    if recs[i].Seq == kv.applied + 1 {
+      kv.ApplyBatch(recs[i].Seq, &recs[i].Batch)
+      replayed++
+    }
+  }
+
+  // drop a torn record at the tail, if any
+  if err := f.Truncate(good); err != nil {
+    log.Fatal("shardkv storage: ", err)
+  }
+  if _, err := f.Seek(good, io.SeekStart); err != nil {
+    log.Fatal("shardkv storage: ", err)
+  }
+  kv.wal = f
+  kv.logged = len(recs)
+
+  log.Printf("[skv][%d][%d] recovered config %d, applied seq %d, %d ops replayed from %s",
+    kv.gid, kv.me, kv.config.Num, kv.applied, replayed, kv.dir)
+}
+
+// hold kv.mu before call this func
+func (kv *ShardKV) Restore(snap *kvSnapshot) {
+  kv.applied = snap.Applied
+  kv.data = snap.Data
+  kv.versions = snap.Versions
+  kv.dups = snap.Dups
+  kv.prepared = snap.Prepared
+  kv.locks = snap.Locks
+  kv.outcomes = snap.Outcomes
+  kv.config = snap.Config
+  kv.prevConfig = snap.PrevConfig
+  kv.waiting = snap.Waiting
+  kv.outgoing = snap.Outgoing
+  // gob leaves empty maps out
+  if kv.data == nil { kv.data = make(map[string]string) }
+  if kv.versions == nil { kv.versions = make(map[string]int64) }
+  if kv.dups == nil { kv.dups = make(map[int64]DupEntry) }
+  if kv.prepared == nil { kv.prepared = make(map[int64]*Prepared) }
+  if kv.locks == nil { kv.locks = make(map[string]int64) }
+  if kv.outcomes == nil { kv.outcomes = make(map[int64]Outcome) }
+  if kv.waiting == nil { kv.waiting = make(map[int]bool) }
+  if kv.outgoing == nil { kv.outgoing = make(map[int]map[int]*ShardState) }
+  // the time out starts over
+  for _, p := range kv.prepared {
+    p.since = time.Now()
+  }
+}
+
+//
+// make the batch applied at seq durable, and now and then
+// write a snapshot. called by the background worker
+// before it calls Done(seq).
+//
+func (kv *ShardKV) Persist(seq int, batch *paxos.Batch) {
+  if kv.wal == nil {
+    return
+  }
+  if err := writeRecord(kv.wal, &walRecord{ seq, *batch }); err != nil {
+    log.Fatal("shardkv storage: ", err)
+  }
+  if err := kv.wal.Sync(); err != nil {
+    log.Fatal("shardkv storage: ", err)
+  }
+  kv.logged++
+  if kv.logged >= SnapshotEvery {
+    kv.Snapshot()
+  }
+}
+
+//
+// write the whole state to the snapshot file, and empty
+// the log.
+//
+func (kv *ShardKV) Snapshot() {
+  kv.mu.Lock()
+  state := kv.EncodeState()
+  applied := kv.applied
+  kv.mu.Unlock()
+
+  path := filepath.Join(kv.dir, SnapshotFile)
+  f, err := os.OpenFile(path + ".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+  if err == nil {
+    _, err = f.Write(state)
+  }
+  if err == nil { err = f.Sync() }
+  if err == nil { err = f.Close() }
+  if err == nil { err = os.Rename(path + ".tmp", path) }
+  // the records the snapshot holds are skipped on restart
+  // if the server dies before the log is emptied
+  if err == nil { err = kv.wal.Truncate(0) }
+  if err == nil { _, err = kv.wal.Seek(0, io.SeekStart) }
+  if err != nil {
+    log.Fatal("shardkv storage: ", err)
+  }
+  kv.logged = 0
+  log.Printf("[skv][%d][%d] snapshot at seq %d, %d bytes", kv.gid, kv.me, applied, len(state))
+}
+
+//
+// the whole state as a gob-encoded kvSnapshot.
+// hold kv.mu before call this func
+//
+func (kv *ShardKV) EncodeState() []byte {
+  var buf bytes.Buffer
+  err := gob.NewEncoder(&buf).Encode(&kvSnapshot{ kv.applied, kv.data, kv.versions, kv.dups,
+    kv.prepared, kv.locks, kv.outcomes, kv.config, kv.prevConfig, kv.waiting, kv.outgoing })
+  if err != nil {
+    log.Fatal("shardkv storage: ", err)
+  }
+  return buf.Bytes()
+}
@@ -12,10 +12,63 @@ import "syscall"
 import "encoding/gob"
 import "math/rand"
 import "shardmaster"
+import "path/filepath"
+import "bytes"
 
 
+const (
+  OpGet = "OpGet"
+  OpPut = "OpPut"
+  OpPrepare = "OpPrepare"
+  OpCommit = "OpCommit"
+  OpAbort = "OpAbort"
+  OpReconfig = "OpReconfig"
+  OpInstall = "OpInstall"
+  OpDropOutgoing = "OpDropOutgoing"
+)
+
+type OpType string
+
 type Op struct {
   // Your definitions here.
+  // 0 for the ops a server makes itself; those are
+  // not in the duplicate table.
+  ClientId int64
+  Seq int64
+  OpType OpType
+  Key string
+  Value string
+  // transactions only, see txn.go
+  TxnId int64
+  Reads map[string]int64
+  Writes map[string]string
+  CoordServers []string
+  // reconfiguration only, see migrate.go
+  Config shardmaster.Config
+  Shard int
+  Data map[string]string
+  Versions map[string]int64
+  Dups map[int64]DupEntry
+  // when the op was proposed, see txn.go
+  Now time.Time
+}
+
+type Result struct {
+  Err Err
+  Value string
+  Version int64
+}
+
+// identifies a request: the clerk and its seq
+type OpId struct {
+  ClientId int64
+  Seq int64
+}
+
+// the latest request applied for a clerk, and its result
+type DupEntry struct {
+  Seq int64
+  Result Result
 }
 
 type ShardKV struct {
@@ -26,31 +79,418 @@ type ShardKV struct {
   unreliable bool // for testing
   sm *shardmaster.Clerk
   px *paxos.Paxos
+  servers []string
 
   gid int64 // my replica group ID
 
   // Your definitions here.
+  data map[string]string
+  // bumped by every write of a key, so that a transaction
+  // can tell whether a key it read has changed since
+  versions map[string]int64
+  // the seq number of the latest applied log instance
+  applied int
+  // handlers waiting for their op to be applied
+  waiters map[OpId][]chan Result
+  // one entry per clerk, by ClientId
+  dups map[int64]DupEntry
+  batcher *paxos.Batcher
+
+  // prepared transactions by TxnId, the keys they lock,
+  // and the transactions decided here
+  prepared map[int64]*Prepared
+  locks map[string]int64
+  outcomes map[int64]Outcome
+
+  // the configuration applied, and the one before it
+  config shardmaster.Config
+  prevConfig shardmaster.Config
+  // the latest config number the shardmaster has told of
+  latest int
+  // the config number last reported to the shardmaster
+  reported int
+  // shards of prevConfig with keys for this group that are
+  // still to come from their previous owners
+  waiting map[int]bool
+  // the keys handed off, as of the config that moved them,
+  // by their shard in the config before it
+  outgoing map[int]map[int]*ShardState
+
+  // where the state is kept, "" for nowhere; see persist.go
+  dir string
+  wal *os.File
+  // records in wal
+  logged int
+}
+
+const (
+  // how long ops are gathered before they are proposed
+  BatchWindow = 2 * time.Millisecond
+)
+
+func sameOp(a interface{}, b interface{}) bool {
+  return a.(Op).Id() == b.(Op).Id()
+}
+
+func (op Op) Id() OpId {
+  return OpId{ op.ClientId, op.Seq }
+}
+
+func (kv *ShardKV) WaitLog(seq int, timeout time.Duration) (bool, *paxos.Batch) {
+  start := time.Now()
+  sleepms := 10 * time.Millisecond
+  maxsleep := time.Second
+
+  for !kv.dead {
+    decided, val := kv.px.Status(seq)
+    var batch *paxos.Batch = nil
+    if val != nil {
+      obj := val.(paxos.Batch)
+      batch = &obj
+    }
+
+    if decided {
+      return true, batch
+    }
+
+    if timeout > 0 {
+      elasped := time.Since(start)
+      if elasped >= timeout {
+        return false, batch
+      }
+      if sleepms > timeout - elasped {
+        sleepms = timeout - elasped
+      }
+    }
+
+    time.Sleep(sleepms)
+    if sleepms < maxsleep {
+      sleepms *= 2
+    }
+  }
+
+  return false, nil
+}
+
+//
+// propose op and wait until the background worker has
+// applied it. a zero Result means the server is dead.
+//
+func (kv *ShardKV) AppendOp(op Op) Result {
+  op.Now = time.Now()
+  done := make(chan Result, 1)
+  kv.mu.Lock()
+  kv.waiters[op.Id()] = append(kv.waiters[op.Id()], done)
+  kv.mu.Unlock()
+
+  seq := kv.batcher.Submit(op)
+  log.Printf("[skv][%d][%d] committed %+v, seq %d", kv.gid, kv.me, op, seq)
+
+  for !kv.dead {
+    select {
+    case result := <- done:
+      return result
+    case <- time.After(paxos.LongWait * time.Millisecond):
+    }
+    // seq was skipped by installing a peer's state; the
+    // result is lost, so let the client retry.
+    kv.mu.Lock()
+    skipped := kv.applied >= seq
+    if skipped {
+      kv.DropWaiter(op.Id(), done)
+    }
+    kv.mu.Unlock()
+    if skipped {
+      select {
+      case result := <- done:
+        return result
+      default:
+        return Result{}
+      }
+    }
+  }
+  return Result{}
+}
+
+//
+// stop waiting on done for the op with id.
+// hold kv.mu before call this func
+//
+func (kv *ShardKV) DropWaiter(id OpId, done chan Result) {
+  waiters := kv.waiters[id]
+  for i, w := range waiters {
+    if w == done {
+      waiters = append(waiters[:i], waiters[i+1:]...)
+      break
+    }
+  }
+  if len(waiters) == 0 {
+    delete(kv.waiters, id)
+  } else {
+    kv.waiters[id] = waiters
+  }
 }
 
+//
+// apply op unless it was applied before. a clerk sends
+// one request at a time, so only its latest one can be
+// retried. ErrLocked and ErrWrongGroup are not remembered,
+// since the retry is expected to get a different answer.
+//
+func (kv *ShardKV) ApplyOp(op Op) Result {
+  if op.ClientId == 0 {
+    return kv.DoOp(op)
+  }
+
+  last, ok := kv.dups[op.ClientId]
+  if ok && op.Seq <= last.Seq {
+    log.Printf("[skv][%d][%d] duplicate op %+v, latest seq %d", kv.gid, kv.me, op, last.Seq)
+    if op.Seq == last.Seq {
+      return last.Result
+    }
+    return Result{}
+  }
+
+  result := kv.DoOp(op)
+  if result.Err != ErrLocked && result.Err != ErrWrongGroup {
+    kv.dups[op.ClientId] = DupEntry{ op.Seq, result }
+  }
+  return result
+}
+
+func (kv *ShardKV) DoOp(op Op) Result {
+  switch op.OpType {
+  case OpGet:
+    if !kv.Serves(kv.ShardOf(op.Key)) {
+      return Result{ ErrWrongGroup, "", 0 }
+    }
+    if _, locked := kv.locks[op.Key]; locked {
+      return Result{ ErrLocked, "", 0 }
+    }
+    val, ok := kv.data[op.Key]
+    if ok {
+      return Result{ OK, val, kv.versions[op.Key] }
+    }
+    return Result{ ErrNoKey, "", kv.versions[op.Key] }
+  case OpPut:
+    if !kv.Serves(kv.ShardOf(op.Key)) {
+      return Result{ ErrWrongGroup, "", 0 }
+    }
+    if _, locked := kv.locks[op.Key]; locked {
+      return Result{ ErrLocked, "", 0 }
+    }
+    kv.data[op.Key] = op.Value
+    kv.versions[op.Key]++
+    log.Printf("[skv][%d][%d] write key %s val %s", kv.gid, kv.me, op.Key, op.Value)
+    return Result{ OK, "", kv.versions[op.Key] }
+  case OpPrepare:
+    return kv.ApplyPrepare(op)
+  case OpCommit, OpAbort:
+    return kv.ApplyDecision(op.TxnId, op.OpType == OpCommit, op.Now)
+  case OpReconfig:
+    return kv.ApplyReconfig(op.Config)
+  case OpInstall:
+    return kv.ApplyInstall(op)
+  case OpDropOutgoing:
+    return kv.ApplyDropOutgoing(op.Config)
+  }
+  log.Printf("[skv][%d][%d] committed invalid op %+v", kv.gid, kv.me, op)
+  return Result{}
+}
+
+//
+// apply the ops of a decided batch in order, and hand
+// the results to the handlers waiting for them.
+//
+func (kv *ShardKV) ApplyBatch(seq int, batch *paxos.Batch) {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+
+  for _, v := range batch.Values {
+    op := v.(Op)
+    kv.ForgetOutcomes(op.Now)
+    result := kv.ApplyOp(op)
+    for _, done := range kv.waiters[op.Id()] {
+      done <- result
+    }
+    delete(kv.waiters, op.Id())
+  }
+  kv.applied = seq
+}
+
+func (kv *ShardKV) StartBackgroundWorker() {
+  go func() {
+    for !kv.dead {
+      seq := kv.applied + 1
+      decided, batch := kv.WaitLog(seq, paxos.LongWait * time.Millisecond)
+      if decided {
+        if batch == nil {
+          // paxos has forgotten seq, so the ops can
+          // only come from a peer's state
+          kv.FetchState(seq)
+          continue
+        }
+        kv.ApplyBatch(seq, batch)
+        kv.Persist(seq, batch)
+        kv.px.Done(seq)
+      } else if seq <= kv.px.Max() {
+        // an instance that some peer started but did not
+        // finish; push it forward, with a no-op if need be
+        if batch == nil {
+          kv.px.WaitForSomeMilliseconds(paxos.LongWait)
+          kv.px.Start(seq, paxos.Batch{})
+        } else {
+          kv.px.Start(seq, *batch)
+        }
+      }
+    }
+  }()
+}
+
+//
+// copy the state of a peer that has applied seq, and
+// continue applying the log from where that peer is.
+//
+func (kv *ShardKV) FetchState(seq int) {
+  for !kv.dead {
+    for i, srv := range kv.servers {
+      if i == kv.me { continue }
+      args := &StateArgs{ seq }
+      var reply StateReply
+      ok := call(srv, "ShardKV.State", args, &reply)
+      if !ok || reply.Err != OK { continue }
+
+      var snap kvSnapshot
+      if err := gob.NewDecoder(bytes.NewReader(reply.State)).Decode(&snap); err != nil {
+        continue
+      }
+      kv.mu.Lock()
+      installed := snap.Applied > kv.applied
+      if installed {
+        log.Printf("[skv][%d][%d] install state from %d, applied %d -> %d",
+          kv.gid, kv.me, i, kv.applied, snap.Applied)
+        kv.Restore(&snap)
+      }
+      applied := kv.applied
+      kv.mu.Unlock()
+      if installed && kv.wal != nil {
+        // the log no longer leads up to the state
+        kv.Snapshot()
+      }
+      kv.px.Done(applied)
+      return
+    }
+    time.Sleep(paxos.LongWait * time.Millisecond)
+  }
+}
+
+func (kv *ShardKV) State(args *StateArgs, reply *StateReply) error {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+
+  if kv.applied < args.Seq {
+    reply.Err = ErrBehind
+    return nil
+  }
+  reply.State = kv.EncodeState()
+  reply.Err = OK
+  return nil
+}
 
 func (kv *ShardKV) Get(args *GetArgs, reply *GetReply) error {
 
   // Your code here.
-
+  result := kv.AppendOp(Op{ ClientId: args.ClientId, Seq: args.Seq, OpType: OpGet, Key: args.Key })
+  reply.Err = result.Err
+  reply.Value = result.Value
+  reply.Version = result.Version
   return nil
 }
 
 func (kv *ShardKV) Put(args *PutArgs, reply *PutReply) error {
   // Your code here.
-
+  result := kv.AppendOp(Op{ ClientId: args.ClientId, Seq: args.Seq, OpType: OpPut,
+    Key: args.Key, Value: args.Value })
+  reply.Err = result.Err
   return nil
 }
 
 //
-// Ask the shardmaster if there's a new configuration;
-// if so, re-configure.
+// If the shardmaster has told of a new configuration,
+// re-configure.
 //
 func (kv *ShardKV) tick() {
+  kv.ResolveStaleTxns()
+
+  kv.mu.Lock()
+  waiting := len(kv.waiting) > 0
+  kv.mu.Unlock()
+
+  if waiting {
+    kv.PullShards()
+    return
+  }
+  kv.Reconfigure()
+
+  kv.mu.Lock()
+  num := kv.config.Num
+  report := num > kv.reported
+  kv.mu.Unlock()
+  if report {
+    kv.sm.Report(kv.gid, num)
+    kv.mu.Lock()
+    kv.reported = num
+    kv.mu.Unlock()
+  }
+  kv.DropOutgoing()
+}
+
+//
+// go on to the config after kv.config, if there is one.
+//
+func (kv *ShardKV) Reconfigure() {
+  kv.mu.Lock()
+  num := kv.config.Num
+  latest := kv.latest
+  kv.mu.Unlock()
+
+  if latest <= num {
+    return
+  }
+  // one config at a time; a config the shardmaster has
+  // agreed on is a Query without agreement. if the next
+  // one is dropped, the group took no part in it, and may
+  // go straight to the oldest one kept.
+  next, err := kv.sm.QueryErr(num + 1)
+  if err == shardmaster.ErrCompacted || next.Num == num + 1 {
+    kv.AppendOp(Op{ Seq: nrand(), OpType: OpReconfig, Config: next })
+  }
+}
+
+//
+// wait on the shardmaster for new configs, rather than ask
+// it every tick, and re-configure as soon as one is agreed.
+//
+func (kv *ShardKV) StartWatcher() {
+  go func() {
+    for !kv.dead {
+      kv.mu.Lock()
+      num := kv.latest
+      kv.mu.Unlock()
+
+      config := kv.sm.Watch(num, 0)
+
+      kv.mu.Lock()
+      newer := config.Num > kv.latest
+      if newer {
+        kv.latest = config.Num
+      }
+      kv.mu.Unlock()
+      if newer {
+        kv.Reconfigure()
+      }
+    }
+  }()
 }
 
 
@@ -72,20 +512,52 @@ func (kv *ShardKV) kill() {
 //
 func StartServer(gid int64, shardmasters []string,
                  servers []string, me int) *ShardKV {
+  return StartPersistentServer(gid, shardmasters, servers, me, "")
+}
+
+//
+// like StartServer(), but the server keeps its state in dir,
+// and recovers it from there when restarted with the same dir.
+// an empty dir means nothing is stored.
+//
+func StartPersistentServer(gid int64, shardmasters []string,
+                           servers []string, me int, dir string) *ShardKV {
   gob.Register(Op{})
 
   kv := new(ShardKV)
   kv.me = me
+  kv.servers = servers
   kv.gid = gid
   kv.sm = shardmaster.MakeClerk(shardmasters)
 
   // Your initialization code here.
   // Don't call Join().
+  kv.data = make(map[string]string)
+  kv.versions = make(map[string]int64)
+  kv.applied = -1
+  kv.waiters = make(map[OpId][]chan Result)
+  kv.dups = make(map[int64]DupEntry)
+  kv.prepared = make(map[int64]*Prepared)
+  kv.locks = make(map[string]int64)
+  kv.outcomes = make(map[int64]Outcome)
+  kv.waiting = make(map[int]bool)
+  kv.outgoing = make(map[int]map[int]*ShardState)
 
   rpcs := rpc.NewServer()
   rpcs.Register(kv)
 
-  kv.px = paxos.Make(servers, me, rpcs)
+  kv.dir = dir
+  if dir != "" {
+    kv.Recover()
+    kv.px = paxos.MakePersistent(servers, me, rpcs, filepath.Join(dir, "paxos"))
+    kv.px.Done(kv.applied)
+  } else {
+    kv.px = paxos.Make(servers, me, rpcs)
+  }
+  kv.batcher = paxos.MakeBatcher(kv.px, BatchWindow, sameOp)
+
+  kv.StartBackgroundWorker()
+  kv.StartWatcher()
 
   os.Remove(servers[me])
   l, e := net.Listen("unix", servers[me]);
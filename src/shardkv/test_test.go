@@ -143,8 +143,16 @@ func TestMove(t *testing.T) {
   ck := MakeClerk(smh)
 
   // insert one key per shard
+  config := mck.Query(-1)
+  keys := make([]string, shardmaster.NShards)
+  for i, j := 0, 0; i < shardmaster.NShards; j++ {
+    if k := strconv.Itoa(j); config.ShardOf(k) == i {
+      keys[i] = k
+      i, j = i + 1, -1
+    }
+  }
   for i := 0; i < shardmaster.NShards; i++ {
-    ck.Put(string('0'+i), string('0'+i))
+    ck.Put(keys[i], keys[i])
   }
 
   // add group 1.
@@ -153,7 +161,7 @@ func TestMove(t *testing.T) {
   
   // check that keys are still there.
   for i := 0; i < shardmaster.NShards; i++ {
-    if ck.Get(string('0'+i)) != string('0'+i) {
+    if ck.Get(keys[i]) != keys[i] {
       t.Fatalf("missing key/value")
     }
   }
@@ -168,8 +176,8 @@ func TestMove(t *testing.T) {
   for i := 0; i < shardmaster.NShards; i++ {
     go func(me int) {
       myck := MakeClerk(smh)
-      v := myck.Get(string('0'+me))
-      if v == string('0'+me) {
+      v := myck.Get(keys[me])
+      if v == keys[me] {
         mu.Lock()
         count++
         mu.Unlock()
@@ -189,6 +197,185 @@ func TestMove(t *testing.T) {
   }
 }
 
+//
+// a Put retried at the group a shard moved to is not
+// applied a second time.
+//
+func TestMoveDuplicate(t *testing.T) {
+  smh, gids, ha, _, clean := setup("movedup", false)
+  defer clean()
+
+  fmt.Printf("Test: Duplicate detection moves with the shard ...\n")
+
+  mck := shardmaster.MakeClerk(smh)
+  mck.Join(gids[0], ha[0])
+
+  ck := MakeClerk(smh)
+  ck.Put("a", "0")
+
+  // a Put whose reply got lost
+  args := &PutArgs{ "a", "x", nrand(), 1 }
+  var reply PutReply
+  for call(ha[0][0], "ShardKV.Put", args, &reply) == false || reply.Err != OK {
+    time.Sleep(100 * time.Millisecond)
+  }
+  ck.Put("a", "y")
+
+  mck.Join(gids[1], ha[1])
+  config := mck.Query(-1)
+  mck.Move(config.ShardOf("a"), gids[1])
+  time.Sleep(2 * time.Second)
+  if ck.Get("a") != "y" {
+    t.Fatalf("value lost in the move")
+  }
+
+  // the retry goes to the new owner
+  for iters := 0; ; iters++ {
+    reply = PutReply{}
+    ok := call(ha[1][iters % len(ha[1])], "ShardKV.Put", args, &reply)
+    if ok && reply.Err == OK {
+      break
+    }
+    if iters > 50 {
+      t.Fatalf("retried Put failed: %v", reply.Err)
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+  if v := ck.Get("a"); v != "y" {
+    t.Fatalf("retried Put applied twice; got %v", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// a group drops the shards it handed off once the shardmaster
+// has dropped the config they were handed off in.
+//
+func TestDropOutgoing(t *testing.T) {
+  smh, gids, ha, sa, clean := setup("dropout", false)
+  defer clean()
+
+  fmt.Printf("Test: Shards handed off are dropped ...\n")
+
+  mck := shardmaster.MakeClerk(smh)
+  mck.Join(gids[0], ha[0])
+
+  ck := MakeClerk(smh)
+  for i := 0; i < 20; i++ {
+    ck.Put(strconv.Itoa(i), strconv.Itoa(i))
+  }
+
+  mck.Join(gids[1], ha[1])
+  time.Sleep(2 * time.Second)
+
+  outgoing := func() int {
+    n := 0
+    for _, kv := range sa[0] {
+      kv.mu.Lock()
+      n += len(kv.outgoing)
+      kv.mu.Unlock()
+    }
+    return n
+  }
+  if outgoing() == 0 {
+    t.Fatalf("no shards handed off")
+  }
+
+  // configs that move nothing, until the one the shards
+  // were handed off in is dropped
+  config := mck.Query(-1)
+  for i := 0; i < shardmaster.KeepConfigs; i++ {
+    mck.Move(0, config.Shards[0])
+  }
+  for iters := 0; outgoing() > 0; iters++ {
+    if iters > 50 {
+      t.Fatalf("shards handed off were not dropped")
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+
+  for i := 0; i < 20; i++ {
+    if v := ck.Get(strconv.Itoa(i)); v != strconv.Itoa(i) {
+      t.Fatalf("Get(%v) yielded %v", i, v)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// keys follow their hash range through Split and Merge, also
+// while clerks write them.
+//
+func TestSplitMerge(t *testing.T) {
+  smh, gids, ha, _, clean := setup("split", false)
+  defer clean()
+
+  fmt.Printf("Test: Keys move with Split and Merge ...\n")
+
+  mck := shardmaster.MakeClerk(smh)
+  mck.Join(gids[0], ha[0])
+  mck.Join(gids[1], ha[1])
+
+  ck := MakeClerk(smh)
+  const nkeys = 50
+  for i := 0; i < nkeys; i++ {
+    ck.Put(strconv.Itoa(i), "x")
+  }
+
+  done := false
+  var wg sync.WaitGroup
+  counts := make([]int, nkeys)
+  for i := 0; i < nkeys; i += 10 {
+    wg.Add(1)
+    go func(me int) {
+      defer wg.Done()
+      myck := MakeClerk(smh)
+      for !done {
+        counts[me]++
+        myck.Put(strconv.Itoa(me), strconv.Itoa(counts[me]))
+      }
+    }(i)
+  }
+
+  hot := mck.Query(-1).ShardOf("0")
+  mck.Split(hot)
+  config := mck.Query(-1)
+  if len(config.Shards) != shardmaster.NShards + 1 {
+    t.Fatalf("Split did not add a shard")
+  }
+  // spread the hot shard over both groups
+  if config.Shards[hot] == config.Shards[shardmaster.NShards] {
+    other := gids[0]
+    if config.Shards[hot] == gids[0] {
+      other = gids[1]
+    }
+    mck.Move(shardmaster.NShards, other)
+  }
+  time.Sleep(2 * time.Second)
+  mck.Merge(hot, shardmaster.NShards)
+  time.Sleep(2 * time.Second)
+
+  done = true
+  wg.Wait()
+  for i := 0; i < nkeys; i++ {
+    v := ck.Get(strconv.Itoa(i))
+    if i % 10 == 0 {
+      if v != strconv.Itoa(counts[i]) {
+        t.Fatalf("Get(%v) = %v, expected %v", i, v, counts[i])
+      }
+    } else if v != "x" {
+      t.Fatalf("Get(%v) = %v, expected x", i, v)
+    }
+  }
+  if n := len(mck.Query(-1).Shards); n != shardmaster.NShards {
+    t.Fatalf("Merge left %v shards", n)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
 func TestLimp(t *testing.T) {
   smh, gids, ha, sa, clean := setup("limp", false)
   defer clean()
@@ -309,3 +496,233 @@ func TestConcurrentUnreliable(t *testing.T) {
   doConcurrent(t, true)
   fmt.Printf("  ... Passed\n")
 }
+
+func TestTransactions(t *testing.T) {
+  smh, gids, ha, _, clean := setup("txn", false)
+  defer clean()
+
+  fmt.Printf("Test: Transactions across groups ...\n")
+
+  mck := shardmaster.MakeClerk(smh)
+  for i := 0; i < len(gids); i++ {
+    mck.Join(gids[i], ha[i])
+  }
+
+  // as many accounts as shards, so most transfers span groups
+  const naccounts = shardmaster.NShards
+  const initial = 100
+  ck := MakeClerk(smh)
+  for i := 0; i < naccounts; i++ {
+    ck.Put(strconv.Itoa(i), strconv.Itoa(initial))
+  }
+
+  tx := ck.Begin()
+  tx.Put("0", strconv.Itoa(initial - 1))
+  tx.Put("5", strconv.Itoa(initial + 1))
+  if tx.Get("0") != strconv.Itoa(initial - 1) {
+    t.Fatalf("transaction does not see its own write")
+  }
+  if ck.Get("0") != strconv.Itoa(initial) {
+    t.Fatalf("write visible before commit")
+  }
+  if tx.Commit() == false {
+    t.Fatalf("uncontended transaction aborted")
+  }
+  if ck.Get("0") != strconv.Itoa(initial - 1) || ck.Get("5") != strconv.Itoa(initial + 1) {
+    t.Fatalf("committed writes missing")
+  }
+
+  // a transaction whose read is stale must abort
+  tx = ck.Begin()
+  tx.Get("1")
+  ck.Put("1", strconv.Itoa(initial))
+  tx.Put("1", "0")
+  if tx.Commit() {
+    t.Fatalf("transaction with a stale read committed")
+  }
+  if ck.Get("1") != strconv.Itoa(initial) {
+    t.Fatalf("aborted transaction wrote")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Concurrent transfers keep the total ...\n")
+
+  const nclients = 5
+  const ntransfers = 10
+  var ca [nclients]chan bool
+  for cli := 0; cli < nclients; cli++ {
+    ca[cli] = make(chan bool)
+    go func(me int) {
+      defer func() { ca[me] <- true }()
+      myck := MakeClerk(smh)
+      for i := 0; i < ntransfers; i++ {
+        from := strconv.Itoa(rand.Int() % naccounts)
+        to := strconv.Itoa(rand.Int() % naccounts)
+        for from != to {
+          tx := myck.Begin()
+          a, _ := strconv.Atoi(tx.Get(from))
+          b, _ := strconv.Atoi(tx.Get(to))
+          tx.Put(from, strconv.Itoa(a - 1))
+          tx.Put(to, strconv.Itoa(b + 1))
+          if tx.Commit() {
+            break
+          }
+          time.Sleep(time.Duration(rand.Int() % 20) * time.Millisecond)
+        }
+      }
+    }(cli)
+  }
+  for cli := 0; cli < nclients; cli++ {
+    <- ca[cli]
+  }
+
+  total := 0
+  for i := 0; i < naccounts; i++ {
+    n, _ := strconv.Atoi(ck.Get(strconv.Itoa(i)))
+    total += n
+  }
+  if total != naccounts * initial {
+    t.Fatalf("total is %v, expected %v", total, naccounts * initial)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Locks are released after the clerk dies ...\n")
+
+  // prepare at the coordinator, as a clerk would, and
+  // never decide
+  v7 := ck.Get("7")
+  config := mck.Query(-1)
+  gid := config.Shards[config.ShardOf("7")]
+  args := &PrepareArgs{ TxnId: nrand(), Reads: map[string]int64{},
+    Writes: map[string]string{ "7": "dead" }, CoordServers: config.Groups[gid],
+    ClientId: nrand(), Seq: 1 }
+  var reply PrepareReply
+  for call(config.Groups[gid][0], "ShardKV.Prepare", args, &reply) == false {
+    time.Sleep(100 * time.Millisecond)
+  }
+  if reply.Err != OK {
+    t.Fatalf("Prepare failed: %v", reply.Err)
+  }
+
+  start := time.Now()
+  if ck.Get("7") != v7 {
+    t.Fatalf("write of an aborted transaction visible")
+  }
+  if time.Since(start) < TxnTimeout / 2 {
+    t.Fatalf("Get of a locked key did not wait")
+  }
+  ck.Put("7", "x")
+  if ck.Get("7") != "x" {
+    t.Fatalf("Put after the timeout lost")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestForgetOutcomes(t *testing.T) {
+  fmt.Printf("Test: Old transaction outcomes are forgotten ...\n")
+
+  kv := &ShardKV{ prepared: make(map[int64]*Prepared), locks: make(map[string]int64),
+    outcomes: make(map[int64]Outcome) }
+  t0 := time.Now()
+  kv.ApplyDecision(1, true, t0)
+  kv.ApplyDecision(2, false, t0.Add(OutcomeTTL / 2))
+  if kv.ApplyDecision(1, false, t0.Add(OutcomeTTL / 2)).Err != OK {
+    t.Fatalf("second decision changed the outcome")
+  }
+
+  kv.ForgetOutcomes(t0.Add(OutcomeTTL + time.Second))
+  if _, ok := kv.outcomes[1]; ok {
+    t.Fatalf("outcome older than OutcomeTTL kept")
+  }
+  if o, ok := kv.outcomes[2]; !ok || o.Committed {
+    t.Fatalf("recent outcome lost")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestPersist(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nmasters = 3
+  var sma []*shardmaster.ShardMaster = make([]*shardmaster.ShardMaster, nmasters)
+  var smh []string = make([]string, nmasters)
+  defer mcleanup(sma)
+  for i := 0; i < nmasters; i++ {
+    smh[i] = port("persistm", i)
+  }
+  for i := 0; i < nmasters; i++ {
+    sma[i] = shardmaster.StartServer(smh, i)
+  }
+
+  const nreplicas = 3
+  const gid = 100
+  sa := make([]*ShardKV, nreplicas)
+  ha := make([]string, nreplicas)
+  dirs := make([]string, nreplicas)
+  for i := 0; i < nreplicas; i++ {
+    ha[i] = port("persists", i)
+    dirs[i] = ha[i] + ".d"
+    os.RemoveAll(dirs[i])
+    defer os.RemoveAll(dirs[i])
+  }
+  start := func() {
+    for i := 0; i < nreplicas; i++ {
+      sa[i] = StartPersistentServer(gid, smh, ha, i, dirs[i])
+    }
+  }
+  stop := func() {
+    for i := 0; i < nreplicas; i++ {
+      sa[i].kill()
+    }
+    time.Sleep(500 * time.Millisecond)
+  }
+  start()
+  defer cleanup([][]*ShardKV{ sa })
+
+  mck := shardmaster.MakeClerk(smh)
+  mck.Join(gid, ha)
+
+  fmt.Printf("Test: A group survives a restart of all replicas ...\n")
+
+  ck := MakeClerk(smh)
+  const nkeys = 2 * SnapshotEvery + 10
+  for i := 0; i < nkeys; i++ {
+    ck.Put(strconv.Itoa(i), strconv.Itoa(i))
+  }
+
+  stop()
+  start()
+
+  for i := 0; i < nkeys; i++ {
+    if v := ck.Get(strconv.Itoa(i)); v != strconv.Itoa(i) {
+      t.Fatalf("Get(%v) = %v after restart", i, v)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: A restarted replica catches up ...\n")
+
+  sa[0].kill()
+  for i := 0; i < nkeys; i++ {
+    ck.Put(strconv.Itoa(i), "x" + strconv.Itoa(i))
+  }
+  sa[0] = StartPersistentServer(gid, smh, ha, 0, dirs[0])
+  sa[1].kill()
+  sa[2].kill()
+  time.Sleep(500 * time.Millisecond)
+  sa[1] = StartPersistentServer(gid, smh, ha, 1, dirs[1])
+  sa[2] = StartPersistentServer(gid, smh, ha, 2, dirs[2])
+
+  for i := 0; i < nkeys; i++ {
+    if v := ck.Get(strconv.Itoa(i)); v != "x" + strconv.Itoa(i) {
+      t.Fatalf("Get(%v) = %v after restart", i, v)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
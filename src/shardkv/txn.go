@@ -0,0 +1,227 @@
+package shardkv
+
+//
+// Multi-key transactions, by two-phase commit.
+//
+// The Clerk buffers the Puts of a transaction, and keeps the
+// version of each key it read. At Commit it sends each group
+// the transaction touches (a participant) a Prepare with the
+// reads and writes in that group's shards. The group agrees
+// on the Prepare through its Paxos log, and votes yes, locking
+// the keys, if none of them is locked by another transaction
+// and every version read is still current. Gets and Puts of a
+// locked key get ErrLocked until the transaction is decided.
+//
+// The participant with the smallest gid is the coordinator:
+// the transaction's outcome is whichever of Commit and Abort
+// comes first in the coordinator group's log. The Clerk sends
+// Commit to the coordinator only once every participant has
+// voted yes, and then passes the outcome on to the others.
+//
+// A participant that has held a prepared transaction for
+// TxnTimeout, e.g. because the Clerk died, asks the coordinator
+// group, which puts an Abort in its log unless the transaction
+// was already decided, and applies the answer through its own
+// log. So the locks are released even if the Clerk never comes
+// back.
+//
+// A group remembers each outcome for OutcomeTTL after the
+// decision, which must be far longer than any participant
+// stays prepared, so that late questions and retries get the
+// same answer. The age is measured by the times the ops in the
+// log were proposed at, so that all replicas forget an outcome
+// at the same point in the log.
+//
+// A group does not hand off a shard while keys in it are
+// locked, and votes ErrWrongGroup on keys it does not serve;
+// the Clerk then aborts, and tries again under a new TxnId
+// with the new configuration.
+//
+
+import "log"
+import "time"
+
+const TxnTimeout = 2 * time.Second
+const OutcomeTTL = 30 * TxnTimeout
+
+type Outcome struct {
+  Committed bool
+  // Op.Now of the op that decided it
+  Decided time.Time
+}
+
+type Prepared struct {
+  Keys []string
+  Writes map[string]string
+  CoordServers []string
+  // when this server applied the Prepare, for TxnTimeout
+  since time.Time
+}
+
+//
+// vote on a transaction, and lock its keys on a yes.
+// hold kv.mu before call this func
+//
+func (kv *ShardKV) ApplyPrepare(op Op) Result {
+  if outcome, ok := kv.outcomes[op.TxnId]; ok {
+    if outcome.Committed {
+      return Result{ OK, "", 0 }
+    }
+    return Result{ ErrAborted, "", 0 }
+  }
+  if _, ok := kv.prepared[op.TxnId]; ok {
+    return Result{ OK, "", 0 }
+  }
+  for key := range op.Reads {
+    if !kv.Serves(kv.ShardOf(key)) {
+      return Result{ ErrWrongGroup, "", 0 }
+    }
+  }
+  for key := range op.Writes {
+    if !kv.Serves(kv.ShardOf(key)) {
+      return Result{ ErrWrongGroup, "", 0 }
+    }
+  }
+
+  var keys []string
+  for key := range op.Reads {
+    keys = append(keys, key)
+  }
+  for key := range op.Writes {
+    if _, ok := op.Reads[key]; !ok {
+      keys = append(keys, key)
+    }
+  }
+
+  vote := true
+  for _, key := range keys {
+    if _, locked := kv.locks[key]; locked {
+      vote = false
+    }
+  }
+  for key, version := range op.Reads {
+    if kv.versions[key] != version {
+      vote = false
+    }
+  }
+  if !vote {
+    // the coordinator cannot commit without this vote
+    kv.outcomes[op.TxnId] = Outcome{ false, op.Now }
+    log.Printf("[skv][%d][%d] txn %d: vote no", kv.gid, kv.me, op.TxnId)
+    return Result{ ErrAborted, "", 0 }
+  }
+
+  for _, key := range keys {
+    kv.locks[key] = op.TxnId
+  }
+  kv.prepared[op.TxnId] = &Prepared{ keys, op.Writes, op.CoordServers, time.Now() }
+  log.Printf("[skv][%d][%d] txn %d: prepared, keys %v", kv.gid, kv.me, op.TxnId, keys)
+  return Result{ OK, "", 0 }
+}
+
+//
+// the first decision for a transaction sticks; later ones
+// get the same answer. replies OK if it committed.
+// hold kv.mu before call this func
+//
+func (kv *ShardKV) ApplyDecision(txnId int64, commit bool, now time.Time) Result {
+  if _, ok := kv.outcomes[txnId]; !ok {
+    kv.outcomes[txnId] = Outcome{ commit, now }
+  }
+  committed := kv.outcomes[txnId].Committed
+
+  if p, ok := kv.prepared[txnId]; ok {
+    if committed {
+      for key, value := range p.Writes {
+        kv.data[key] = value
+        kv.versions[key]++
+      }
+    }
+    for _, key := range p.Keys {
+      delete(kv.locks, key)
+    }
+    delete(kv.prepared, txnId)
+    log.Printf("[skv][%d][%d] txn %d: committed %v", kv.gid, kv.me, txnId, committed)
+  }
+
+  if committed {
+    return Result{ OK, "", 0 }
+  }
+  return Result{ ErrAborted, "", 0 }
+}
+
+//
+// forget the outcomes decided more than OutcomeTTL before
+// now, the Op.Now of an op being applied.
+// hold kv.mu before call this func
+//
+func (kv *ShardKV) ForgetOutcomes(now time.Time) {
+  for id, outcome := range kv.outcomes {
+    if now.Sub(outcome.Decided) > OutcomeTTL {
+      delete(kv.outcomes, id)
+    }
+  }
+}
+
+func (kv *ShardKV) Prepare(args *PrepareArgs, reply *PrepareReply) error {
+  result := kv.AppendOp(Op{ ClientId: args.ClientId, Seq: args.Seq, OpType: OpPrepare,
+    TxnId: args.TxnId, Reads: args.Reads, Writes: args.Writes, CoordServers: args.CoordServers })
+  reply.Err = result.Err
+  return nil
+}
+
+func (kv *ShardKV) Decide(args *DecideArgs, reply *DecideReply) error {
+  op := Op{ ClientId: args.ClientId, Seq: args.Seq, OpType: OpAbort, TxnId: args.TxnId }
+  if args.Commit {
+    op.OpType = OpCommit
+  }
+  result := kv.AppendOp(op)
+  reply.Err = result.Err
+  return nil
+}
+
+//
+// called at the coordinator group by a participant that
+// gave up waiting for the outcome.
+//
+func (kv *ShardKV) TxnStatus(args *TxnStatusArgs, reply *TxnStatusReply) error {
+  result := kv.AppendOp(Op{ Seq: nrand(), OpType: OpAbort, TxnId: args.TxnId })
+  if result.Err == "" {
+    return nil
+  }
+  reply.Err = OK
+  reply.Committed = result.Err == OK
+  return nil
+}
+
+//
+// ask the coordinator about the transactions that have
+// been prepared here for too long, and apply the answers.
+//
+func (kv *ShardKV) ResolveStaleTxns() {
+  kv.mu.Lock()
+  stale := make(map[int64][]string)
+  for id, p := range kv.prepared {
+    if time.Since(p.since) > TxnTimeout {
+      stale[id] = p.CoordServers
+    }
+  }
+  kv.mu.Unlock()
+
+  for id, servers := range stale {
+    for _, srv := range servers {
+      args := &TxnStatusArgs{ id }
+      var reply TxnStatusReply
+      ok := call(srv, "ShardKV.TxnStatus", args, &reply)
+      if ok && reply.Err == OK {
+        log.Printf("[skv][%d][%d] txn %d: timed out, committed %v", kv.gid, kv.me, id, reply.Committed)
+        op := Op{ Seq: nrand(), OpType: OpAbort, TxnId: id }
+        if reply.Committed {
+          op.OpType = OpCommit
+        }
+        kv.AppendOp(op)
+        break
+      }
+    }
+  }
+}
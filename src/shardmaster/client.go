@@ -2,19 +2,29 @@ package shardmaster
 
 // 
 // Shardmaster clerk.
-// Please don't change this file.
 //
 
 import "net/rpc"
 import "time"
+import "sync"
 
 type Clerk struct {
   servers []string // shardmaster replicas
+  mu sync.Mutex
+  // the server Watch asks first
+  watchAt int
+  // identify Splits and Merges, so that retries are
+  // not applied twice. held through each of them, so
+  // that they reach the servers in order of seq
+  opMu sync.Mutex
+  clientId int64
+  seq int64
 }
 
 func MakeClerk(servers []string) *Clerk {
   ck := new(Clerk)
   ck.servers = servers
+  ck.clientId = nrand()
   return ck
 }
 
@@ -49,7 +59,22 @@ func call(srv string, rpcname string,
   return false
 }
 
+//
+// config num, or one with Num -1 if it is no longer kept.
+//
 func (ck *Clerk) Query(num int) Config {
+  config, err := ck.QueryErr(num)
+  if err == ErrCompacted {
+    return Config{ Num: -1 }
+  }
+  return config
+}
+
+//
+// like Query(), but says ErrCompacted, along with the oldest
+// config kept, if config num is no longer kept.
+//
+func (ck *Clerk) QueryErr(num int) (Config, Err) {
   for {
     // try each known server.
     for _, srv := range ck.servers {
@@ -57,22 +82,114 @@ func (ck *Clerk) Query(num int) Config {
       args.Num = num
       var reply QueryReply
       ok := call(srv, "ShardMaster.Query", args, &reply)
+      if ok && reply.Err != "" {
+        return reply.Config, reply.Err
+      }
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+}
+
+//
+// tell the shardmaster that group gid has applied config
+// num, so that the configs before it may be dropped.
+//
+func (ck *Clerk) Report(gid int64, num int) {
+  for {
+    // try each known server.
+    for _, srv := range ck.servers {
+      args := &ReportArgs{}
+      args.GID = gid
+      args.Num = num
+      var reply ReportReply
+      ok := call(srv, "ShardMaster.Report", args, &reply)
       if ok {
+        return
+      }
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+}
+
+//
+// wait for a config newer than num, up to timeout (0 for
+// WatchTimeout), and return the latest config the server
+// knows, which is not newer than num after a timeout.
+//
+func (ck *Clerk) Watch(num int, timeout time.Duration) Config {
+  for {
+    ck.mu.Lock()
+    at := ck.watchAt
+    ck.mu.Unlock()
+    // try each known server.
+    for i := range ck.servers {
+      srv := ck.servers[(at + i) % len(ck.servers)]
+      args := &WatchArgs{}
+      args.Num = num
+      args.Timeout = timeout
+      var reply WatchReply
+      ok := call(srv, "ShardMaster.Watch", args, &reply)
+      if ok {
+        if reply.Config.Num <= num {
+          // timed out; the server may have missed a
+          // decision that others know of
+          ck.mu.Lock()
+          ck.watchAt = (at + i + 1) % len(ck.servers)
+          ck.mu.Unlock()
+        }
         return reply.Config
       }
     }
     time.Sleep(100 * time.Millisecond)
   }
-  return Config{}
+}
+
+//
+// send each config newer than num on the returned channel,
+// in order of Num, skipping none that is still kept, until
+// stop is closed; then close the channel.
+//
+func (ck *Clerk) Subscribe(num int, stop chan bool) <-chan Config {
+  ch := make(chan Config)
+  go func() {
+    defer close(ch)
+    for {
+      select {
+      case <-stop:
+        return
+      default:
+      }
+      latest := ck.Watch(num, 0)
+      for latest.Num > num {
+        c := latest
+        if c.Num > num + 1 {
+          // the oldest config kept if num + 1 is not
+          c, _ = ck.QueryErr(num + 1)
+        }
+        select {
+        case ch <- c:
+          num = c.Num
+        case <-stop:
+          return
+        }
+      }
+    }
+  }()
+  return ch
 }
 
 func (ck *Clerk) Join(gid int64, servers []string) {
+  ck.JoinWeighted(gid, servers, 1)
+}
+
+func (ck *Clerk) JoinWeighted(gid int64, servers []string, weight int) {
   for {
     // try each known server.
     for _, srv := range ck.servers {
       args := &JoinArgs{}
       args.GID = gid
       args.Servers = servers
+      args.Weight = weight
       var reply JoinReply
       ok := call(srv, "ShardMaster.Join", args, &reply)
       if ok {
@@ -115,3 +232,69 @@ func (ck *Clerk) Move(shard int, gid int64) {
     time.Sleep(100 * time.Millisecond)
   }
 }
+
+func (ck *Clerk) SetWeight(gid int64, weight int) {
+  for {
+    // try each known server.
+    for _, srv := range ck.servers {
+      args := &SetWeightArgs{}
+      args.GID = gid
+      args.Weight = weight
+      var reply SetWeightReply
+      ok := call(srv, "ShardMaster.SetWeight", args, &reply)
+      if ok {
+        return
+      }
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+}
+
+//
+// a clerk sends one Split or Merge at a time; the servers
+// ignore one older than the latest they have applied.
+//
+func (ck *Clerk) Split(shard int) {
+  ck.opMu.Lock()
+  defer ck.opMu.Unlock()
+  ck.seq++
+  seq := ck.seq
+  for {
+    // try each known server.
+    for _, srv := range ck.servers {
+      args := &SplitArgs{}
+      args.Shard = shard
+      args.ClientId = ck.clientId
+      args.Seq = seq
+      var reply SplitReply
+      ok := call(srv, "ShardMaster.Split", args, &reply)
+      if ok {
+        return
+      }
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+}
+
+func (ck *Clerk) Merge(a int, b int) {
+  ck.opMu.Lock()
+  defer ck.opMu.Unlock()
+  ck.seq++
+  seq := ck.seq
+  for {
+    // try each known server.
+    for _, srv := range ck.servers {
+      args := &MergeArgs{}
+      args.A = a
+      args.B = b
+      args.ClientId = ck.clientId
+      args.Seq = seq
+      var reply MergeReply
+      ok := call(srv, "ShardMaster.Merge", args, &reply)
+      if ok {
+        return
+      }
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+}
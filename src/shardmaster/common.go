@@ -4,33 +4,79 @@ package shardmaster
 // Master shard server: assigns shards to replication groups.
 //
 // RPC interface:
-// Join(gid, servers) -- replica group gid is joining, give it some shards.
+// Join(gid, servers, weight) -- replica group gid is joining, give it some
+//   shards, in proportion to its weight.
 // Leave(gid) -- replica group gid is retiring, hand off all its shards.
 // Move(shard, gid) -- hand off one shard from current owner to gid.
+// Split(shard) -- cut a shard's key range in two; the new half is
+//   shard len(Shards), given to the group with the fewest shards for
+//   its weight.
+// Merge(a, b) -- join two shards with neighbouring key ranges into
+//   one; the shards after the one that goes away are renumbered.
+// SetWeight(gid, weight) -- change a group's weight and move shards
+//   to match it.
 // Query(num) -> fetch Config # num, or latest config if num==-1.
+// Watch(num, timeout) -> wait for a Config with Num > num, and fetch
+//   the latest config; it may be older than that after the timeout.
+//   Unlike Query(-1), Watch is answered from what the server has
+//   learned, without agreeing on anything; a server that missed a
+//   decision times out, and the Clerk asks another one next time.
+// Report(gid, num) -- replica group gid has applied Config # num.
+//
+// Old configs are dropped: the latest KeepConfigs are kept, and so
+// is every config from the lowest number a group has reported, or,
+// for a group that has not reported yet, from the config before the
+// one it joined in. A group that leaves is held to until it reports
+// the config it left in. Query(num) for a dropped config says
+// ErrCompacted.
 //
 // A Config (configuration) describes a set of replica groups, and the
 // replica group responsible for each shard. Configs are numbered. Config
 // #0 is the initial configuration, with no groups and all shards
-// assigned to group 0 (the invalid group).
+// assigned to group 0 (the invalid group). The number of shards is
+// len(Config.Shards), chosen when the shardmaster servers are started,
+// and changed by Split and Merge; see layout.go for the keys each
+// shard holds.
+//
+// A group's weight is its capacity relative to the other groups: a
+// group of weight 2 gets about twice the shards of a group of weight 1.
 //
 // A GID is a replica group ID. GIDs must be uniqe and > 0.
 // Once a GID joins, and leaves, it should never join again.
 //
-// Please don't change this file.
-//
 
+import "time"
+
+// the number of shards StartServer() makes
 const NShards = 10
 
+// the longest a Watch waits
+const WatchTimeout = 2 * time.Second
+
+// how many of the latest configs are always kept
+const KeepConfigs = 10
+
+const (
+  OK = "OK"
+  // the config asked for is no longer kept
+  ErrCompacted = "ErrCompacted"
+  // the server has not applied the instance asked for
+  ErrBehind = "ErrBehind"
+)
+type Err string
+
 type Config struct {
   Num int // config number
-  Shards [NShards]int64 // gid
+  Shards []int64 // gid
+  Starts []uint32 // the lowest key hash in each shard
   Groups map[int64][]string // gid -> servers[]
+  Weights map[int64]int // gid -> weight
 }
 
 type JoinArgs struct {
   GID int64       // unique replica group ID
   Servers []string // group server ports
+  Weight int // 0 for the default weight, 1
 }
 
 type JoinReply struct {
@@ -51,10 +97,74 @@ type MoveArgs struct {
 type MoveReply struct {
 }
 
+type SetWeightArgs struct {
+  GID int64
+  Weight int
+}
+
+type SetWeightReply struct {
+}
+
+// a clerk's Split and Merge are applied at most once: the
+// servers keep the latest Seq of each ClientId.
+type SplitArgs struct {
+  Shard int
+  ClientId int64
+  Seq int64
+}
+
+type SplitReply struct {
+}
+
+type MergeArgs struct {
+  A int
+  B int
+  ClientId int64
+  Seq int64
+}
+
+type MergeReply struct {
+}
+
+type WatchArgs struct {
+  Num int
+  Timeout time.Duration // 0 for WatchTimeout
+}
+
+type WatchReply struct {
+  Config Config
+}
+
 type QueryArgs struct {
     Num int // desired config number
 }
 
 type QueryReply struct {
+  Err Err
+  // with ErrCompacted, the oldest config kept
   Config Config
 }
+
+type ReportArgs struct {
+  GID int64
+  Num int
+}
+
+type ReportReply struct {
+}
+
+// between shardmaster servers, see FetchState()
+type StateArgs struct {
+  // the caller needs the state with instances <= Seq applied
+  Seq int
+}
+
+type StateReply struct {
+  Err Err
+  Applied int
+  Configs []Config
+  Base int
+  InUse map[int64]int
+  LeftAt map[int64]int
+  Dups map[int64]int64
+}
@@ -0,0 +1,80 @@
+package shardmaster
+
+//
+// Key layout: which shard a key is in.
+//
+// A key is placed by its 32-bit FNV-1a hash. Each shard holds
+// a contiguous range of hashes, from Config.Starts[shard] up
+// to the next higher start (or the top of the hash space).
+// The first config cuts the hash space into equal ranges;
+// Split() halves a range into a new shard and Merge() joins
+// two neighbouring ranges, so a shard's index may change
+// from one config to the next but its range says which keys
+// it holds. clients and servers must both use ShardOf().
+//
+
+import "hash/fnv"
+
+const (
+  // one above the largest key hash
+  HashSpace = uint64(1) << 32
+)
+
+func KeyHash(key string) uint32 {
+  h := fnv.New32a()
+  h.Write([]byte(key))
+  return h.Sum32()
+}
+
+//
+// the starts of nshards equal ranges.
+//
+func UniformStarts(nshards int) []uint32 {
+  starts := make([]uint32, nshards)
+  for i := range starts {
+    starts[i] = uint32(uint64(i) * HashSpace / uint64(nshards))
+  }
+  return starts
+}
+
+//
+// which shard of config is key in? 0 if config has no shards.
+//
+func (config Config) ShardOf(key string) int {
+  // some shard starts at 0, so there is always a start <= h
+  h := KeyHash(key)
+  shard := -1
+  for i, start := range config.Starts {
+    if start <= h && (shard < 0 || start > config.Starts[shard]) {
+      shard = i
+    }
+  }
+  if shard < 0 {
+    return 0
+  }
+  return shard
+}
+
+//
+// the hashes [lo, hi) that shard holds.
+//
+func (config Config) Range(shard int) (uint64, uint64) {
+  lo := uint64(config.Starts[shard])
+  hi := HashSpace
+  for _, start := range config.Starts {
+    if uint64(start) > lo && uint64(start) < hi {
+      hi = uint64(start)
+    }
+  }
+  return lo, hi
+}
+
+//
+// do shard of config and shard b of config cb hold any
+// hash in common?
+//
+func (config Config) Overlaps(shard int, cb *Config, b int) bool {
+  lo, hi := config.Range(shard)
+  blo, bhi := cb.Range(b)
+  return lo < bhi && blo < hi
+}
@@ -10,6 +10,10 @@ import "os"
 import "syscall"
 import "encoding/gob"
 import "math/rand"
+import "time"
+import "sort"
+import crand "crypto/rand"
+import "math/big"
 
 type ShardMaster struct {
   mu sync.Mutex
@@ -18,37 +22,590 @@ type ShardMaster struct {
   dead bool // for testing
   unreliable bool // for testing
   px *paxos.Paxos
+  servers []string
 
-  configs []Config // indexed by config num
+  // indexed by config num - base; the configs below base
+  // are dropped, see Compact()
+  configs []Config
+  base int
+  // how many of the latest configs are kept
+  keep int
+  // the config applied by each group, as far as it has said
+  inUse map[int64]int
+  // the config that each group that left is not in
+  leftAt map[int64]int
+  // the latest Split or Merge applied for each clerk
+  dups map[int64]int64
+  // the seq number of the latest applied log instance
+  applied int
+  batcher *paxos.Batcher
 }
 
+const (
+  OpJoin = "OpJoin"
+  OpLeave = "OpLeave"
+  OpMove = "OpMove"
+  OpSetWeight = "OpSetWeight"
+  OpReport = "OpReport"
+  OpSplit = "OpSplit"
+  OpMerge = "OpMerge"
+  // orders a Query after the ops agreed before it
+  OpQuery = "OpQuery"
+)
+
+type OpType string
 
 type Op struct {
   // Your data here.
+  // tells apart ops with the same arguments
+  ReqId int64
+  OpType OpType
+  GID int64
+  Servers []string
+  Weight int
+  Shard int
+  // the second shard of a Merge
+  Other int
+  // the config number of a Report
+  Num int
+  // Split and Merge only; 0 for the other ops
+  ClientId int64
+  Seq int64
+}
+
+const (
+  // how long ops are gathered before they are proposed
+  BatchWindow = 2 * time.Millisecond
+  // how often a Watch looks for new configs
+  WatchPoll = 10 * time.Millisecond
+)
+
+func sameOp(a interface{}, b interface{}) bool {
+  return a.(Op).ReqId == b.(Op).ReqId
+}
+
+func nrand() int64 {
+  max := big.NewInt(int64(1) << 62)
+  bigx, _ := crand.Int(crand.Reader, max)
+  return bigx.Int64()
+}
+
+//
+// agree on op, then apply the log up to and including
+// it. returns false if the server died.
+//
+func (sm *ShardMaster) Sync(op Op) bool {
+  seq := sm.batcher.Submit(op)
+  if seq < 0 {
+    return false
+  }
+
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+  sm.ApplyUpTo(seq)
+  return !sm.dead
+}
+
+//
+// apply the log up to and including seq, filling in the
+// instances that are not decided.
+// hold sm.mu before call this func
+//
+func (sm *ShardMaster) ApplyUpTo(seq int) {
+  for sm.applied < seq && !sm.dead {
+    next := sm.applied + 1
+    decided, v := sm.WaitLog(next)
+    if !decided {
+      // some peer started next but did not finish
+      sm.px.Start(next, paxos.Batch{})
+      continue
+    }
+    if v == nil {
+      // paxos has forgotten next, so the ops can
+      // only come from a peer's state
+      sm.FetchState(next)
+      continue
+    }
+    sm.ApplyBatch(next, v)
+  }
+}
+
+//
+// apply the instances this server has learned are decided,
+// without starting any.
+// hold sm.mu before call this func
+//
+func (sm *ShardMaster) CatchUp() {
+  for !sm.dead {
+    next := sm.applied + 1
+    decided, v := sm.px.Status(next)
+    if !decided {
+      return
+    }
+    if v == nil {
+      sm.FetchState(next)
+      continue
+    }
+    sm.ApplyBatch(next, v)
+  }
+}
+
+// hold sm.mu before call this func
+func (sm *ShardMaster) ApplyBatch(seq int, v interface{}) {
+  batch := v.(paxos.Batch)
+  for _, x := range batch.Values {
+    sm.ApplyOp(x.(Op))
+  }
+  sm.applied = seq
+  sm.px.Done(seq)
+}
+
+//
+// copy the state of a peer that has applied seq, and
+// continue applying the log from where that peer is.
+// hold sm.mu before call this func; it is released while
+// the peers are asked.
+//
+func (sm *ShardMaster) FetchState(seq int) {
+  for !sm.dead {
+    for i, srv := range sm.servers {
+      if i == sm.me { continue }
+      args := &StateArgs{ seq }
+      var reply StateReply
+      sm.mu.Unlock()
+      ok := call(srv, "ShardMaster.State", args, &reply)
+      sm.mu.Lock()
+      if !ok || reply.Err != OK { continue }
+
+      if reply.Applied > sm.applied {
+        log.Printf("[sm][%d] install state from %d, applied %d -> %d", sm.me, i, sm.applied, reply.Applied)
+        sm.configs = reply.Configs
+        sm.base = reply.Base
+        sm.inUse = reply.InUse
+        sm.leftAt = reply.LeftAt
+        sm.dups = reply.Dups
+        // gob leaves empty maps out
+        if sm.inUse == nil { sm.inUse = make(map[int64]int) }
+        if sm.leftAt == nil { sm.leftAt = make(map[int64]int) }
+        if sm.dups == nil { sm.dups = make(map[int64]int64) }
+        sm.applied = reply.Applied
+        sm.px.Done(sm.applied)
+      }
+      return
+    }
+    sm.mu.Unlock()
+    time.Sleep(paxos.LongWait * time.Millisecond)
+    sm.mu.Lock()
+  }
+}
+
+func (sm *ShardMaster) State(args *StateArgs, reply *StateReply) error {
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+
+  if sm.applied < args.Seq {
+    reply.Err = ErrBehind
+    return nil
+  }
+
+  reply.Applied = sm.applied
+  // an agreed config never changes, so they can be shared
+  reply.Configs = append([]Config{}, sm.configs...)
+  reply.Base = sm.base
+  reply.InUse = make(map[int64]int)
+  for gid, num := range sm.inUse {
+    reply.InUse[gid] = num
+  }
+  reply.LeftAt = make(map[int64]int)
+  for gid, num := range sm.leftAt {
+    reply.LeftAt[gid] = num
+  }
+  reply.Dups = make(map[int64]int64)
+  for client, seq := range sm.dups {
+    reply.Dups[client] = seq
+  }
+  reply.Err = OK
+  return nil
+}
+
+//
+// wait a while for seq to be decided.
+//
+func (sm *ShardMaster) WaitLog(seq int) (bool, interface{}) {
+  sleep := paxos.ShortWait * time.Millisecond
+  for i := 0; i < 10 && !sm.dead; i++ {
+    decided, v := sm.px.Status(seq)
+    if decided {
+      return true, v
+    }
+    time.Sleep(sleep)
+    if sleep < paxos.LongWait * time.Millisecond {
+      sleep *= 2
+    }
+  }
+  return false, nil
+}
+
+// hold sm.mu before call this func
+func (sm *ShardMaster) ApplyOp(op Op) {
+  if op.ClientId != 0 {
+    if op.Seq <= sm.dups[op.ClientId] {
+      // a retry
+      return
+    }
+    sm.dups[op.ClientId] = op.Seq
+  }
+  switch op.OpType {
+  case OpJoin:
+    if _, ok := sm.Latest().Groups[op.GID]; ok {
+      return
+    }
+    config := sm.NextConfig()
+    config.Groups[op.GID] = op.Servers
+    if _, ok := sm.inUse[op.GID]; !ok {
+      // it starts from the config before this one
+      sm.inUse[op.GID] = config.Num - 1
+    }
+    config.Weights[op.GID] = op.Weight
+    if op.Weight <= 0 {
+      config.Weights[op.GID] = 1
+    }
+    Rebalance(config)
+  case OpLeave:
+    if _, ok := sm.Latest().Groups[op.GID]; !ok {
+      return
+    }
+    config := sm.NextConfig()
+    delete(config.Groups, op.GID)
+    delete(config.Weights, op.GID)
+    sm.leftAt[op.GID] = config.Num
+    Rebalance(config)
+  case OpReport:
+    _, member := sm.Latest().Groups[op.GID]
+    _, left := sm.leftAt[op.GID]
+    if !member && !left || op.Num <= sm.inUse[op.GID] {
+      return
+    }
+    sm.inUse[op.GID] = op.Num
+    if left && op.Num >= sm.leftAt[op.GID] {
+      // it has handed off its shards
+      delete(sm.inUse, op.GID)
+      delete(sm.leftAt, op.GID)
+    }
+  case OpSetWeight:
+    latest := sm.Latest()
+    if _, ok := latest.Groups[op.GID]; !ok || op.Weight <= 0 || latest.Weights[op.GID] == op.Weight {
+      return
+    }
+    config := sm.NextConfig()
+    config.Weights[op.GID] = op.Weight
+    Rebalance(config)
+  case OpMove:
+    if op.Shard < 0 || op.Shard >= len(sm.Latest().Shards) {
+      return
+    }
+    config := sm.NextConfig()
+    config.Shards[op.Shard] = op.GID
+  case OpSplit:
+    latest := sm.Latest()
+    if op.Shard < 0 || op.Shard >= len(latest.Shards) {
+      return
+    }
+    if lo, hi := latest.Range(op.Shard); hi - lo < 2 {
+      return
+    }
+    Split(sm.NextConfig(), op.Shard)
+  case OpMerge:
+    latest := sm.Latest()
+    if op.Shard < 0 || op.Shard >= len(latest.Shards) ||
+       op.Other < 0 || op.Other >= len(latest.Shards) {
+      return
+    }
+    alo, ahi := latest.Range(op.Shard)
+    blo, bhi := latest.Range(op.Other)
+    if ahi != blo && bhi != alo {
+      return
+    }
+    config := sm.NextConfig()
+    Merge(config, op.Shard, op.Other)
+    Rebalance(config)
+  }
+  sm.Compact()
+}
+
+//
+// drop the configs that are neither among the latest
+// sm.keep nor in use by a group.
+// hold sm.mu before call this func
+//
+func (sm *ShardMaster) Compact() {
+  horizon := sm.Latest().Num - sm.keep + 1
+  for _, num := range sm.inUse {
+    if num < horizon {
+      horizon = num
+    }
+  }
+  if horizon <= sm.base {
+    return
+  }
+  sm.configs = append([]Config{}, sm.configs[horizon - sm.base:]...)
+  sm.base = horizon
+}
+
+//
+// config num, or nil if it is dropped or not agreed yet.
+// hold sm.mu before call this func
+//
+func (sm *ShardMaster) Config(num int) *Config {
+  if num < sm.base || num - sm.base >= len(sm.configs) {
+    return nil
+  }
+  return &sm.configs[num - sm.base]
+}
+
+//
+// cut shard in two: it keeps the lower half of its range,
+// and the upper half becomes a new, last, shard. the new
+// shard goes to the group that would hold the fewest shards
+// for its weight (the smallest gid of those), which keeps
+// the config balanced.
+//
+func Split(config *Config, shard int) {
+  lo, hi := config.Range(shard)
+  config.Starts = append(config.Starts, uint32(lo + (hi - lo) / 2))
+
+  counts := make(map[int64]int)
+  for _, gid := range config.Shards {
+    counts[gid]++
+  }
+  gid := config.Shards[shard]
+  for g := range config.Groups {
+    // (counts[g]+1)/w(g) against (counts[gid]+1)/w(gid)
+    a := (counts[g] + 1) * config.Weight(gid)
+    b := (counts[gid] + 1) * config.Weight(g)
+    if a < b || a == b && g < gid {
+      gid = g
+    }
+  }
+  config.Shards = append(config.Shards, gid)
+}
+
+//
+// join neighbouring shards a and b into the one with the
+// lower range, and renumber the shards after the other.
+//
+func Merge(config *Config, a int, b int) {
+  if config.Starts[b] < config.Starts[a] {
+    a, b = b, a
+  }
+  config.Shards = append(config.Shards[:b], config.Shards[b+1:]...)
+  config.Starts = append(config.Starts[:b], config.Starts[b+1:]...)
 }
 
+// hold sm.mu before call this func
+func (sm *ShardMaster) Latest() *Config {
+  return &sm.configs[len(sm.configs) - 1]
+}
+
+//
+// append a copy of the latest config, numbered one above.
+// hold sm.mu before call this func
+//
+func (sm *ShardMaster) NextConfig() *Config {
+  old := sm.Latest()
+  config := Config{ old.Num + 1, make([]int64, len(old.Shards)),
+    make([]uint32, len(old.Starts)), make(map[int64][]string), make(map[int64]int) }
+  copy(config.Shards, old.Shards)
+  copy(config.Starts, old.Starts)
+  for gid, servers := range old.Groups {
+    config.Groups[gid] = servers
+  }
+  for gid, weight := range old.Weights {
+    config.Weights[gid] = weight
+  }
+  sm.configs = append(sm.configs, config)
+  return sm.Latest()
+}
+
+//
+// the weight of group gid, 1 if it has none.
+//
+func (config Config) Weight(gid int64) int {
+  if w, ok := config.Weights[gid]; ok && w > 0 {
+    return w
+  }
+  return 1
+}
+
+//
+// spread the shards over the groups in proportion to their
+// weights, moving as few shards as possible: each group's
+// share is nshards*weight/total rounded down, and the shards
+// left over go one each to the groups with the largest
+// remainders, then to those that hold the most already. only
+// the shards of groups that are gone, and those above a
+// group's share, move. ties are broken by gid, so that every
+// replica computes the same config.
+//
+func Rebalance(config *Config) {
+  var gids []int64
+  for gid := range config.Groups {
+    gids = append(gids, gid)
+  }
+  if len(gids) == 0 {
+    for shard := range config.Shards {
+      config.Shards[shard] = 0
+    }
+    return
+  }
+
+  counts := make(map[int64]int)
+  for _, gid := range config.Shards {
+    counts[gid]++
+  }
+  nshards := len(config.Shards)
+  total := 0
+  for _, gid := range gids {
+    total += config.Weight(gid)
+  }
+  share := make(map[int64]int)
+  rem := make(map[int64]int)
+  left := nshards
+  for _, gid := range gids {
+    share[gid] = nshards * config.Weight(gid) / total
+    rem[gid] = nshards * config.Weight(gid) % total
+    left -= share[gid]
+  }
+  sort.Slice(gids, func(i, j int) bool {
+    if rem[gids[i]] != rem[gids[j]] {
+      return rem[gids[i]] > rem[gids[j]]
+    }
+    if counts[gids[i]] != counts[gids[j]] {
+      return counts[gids[i]] > counts[gids[j]]
+    }
+    return gids[i] < gids[j]
+  })
+  for i := 0; i < left; i++ {
+    share[gids[i]]++
+  }
+
+  var free []int
+  for shard, gid := range config.Shards {
+    if _, ok := config.Groups[gid]; !ok || counts[gid] > share[gid] {
+      free = append(free, shard)
+      counts[gid]--
+    }
+  }
+  sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+  for _, gid := range gids {
+    for counts[gid] < share[gid] {
+      config.Shards[free[0]] = gid
+      free = free[1:]
+      counts[gid]++
+    }
+  }
+}
 
 func (sm *ShardMaster) Join(args *JoinArgs, reply *JoinReply) error {
   // Your code here.
-
+  sm.Sync(Op{ ReqId: nrand(), OpType: OpJoin, GID: args.GID, Servers: args.Servers,
+    Weight: args.Weight })
   return nil
 }
 
 func (sm *ShardMaster) Leave(args *LeaveArgs, reply *LeaveReply) error {
   // Your code here.
-
+  sm.Sync(Op{ ReqId: nrand(), OpType: OpLeave, GID: args.GID })
   return nil
 }
 
 func (sm *ShardMaster) Move(args *MoveArgs, reply *MoveReply) error {
   // Your code here.
+  sm.Sync(Op{ ReqId: nrand(), OpType: OpMove, Shard: args.Shard, GID: args.GID })
+  return nil
+}
+
+func (sm *ShardMaster) SetWeight(args *SetWeightArgs, reply *SetWeightReply) error {
+  sm.Sync(Op{ ReqId: nrand(), OpType: OpSetWeight, GID: args.GID, Weight: args.Weight })
+  return nil
+}
 
+func (sm *ShardMaster) Split(args *SplitArgs, reply *SplitReply) error {
+  sm.Sync(Op{ ReqId: nrand(), OpType: OpSplit, Shard: args.Shard,
+    ClientId: args.ClientId, Seq: args.Seq })
+  return nil
+}
+
+func (sm *ShardMaster) Merge(args *MergeArgs, reply *MergeReply) error {
+  sm.Sync(Op{ ReqId: nrand(), OpType: OpMerge, Shard: args.A, Other: args.B,
+    ClientId: args.ClientId, Seq: args.Seq })
   return nil
 }
 
 func (sm *ShardMaster) Query(args *QueryArgs, reply *QueryReply) error {
   // Your code here.
+  // a config never changes once agreed, so one this
+  // server has is as fresh as can be
+  sm.mu.Lock()
+  if args.Num >= 0 && args.Num < sm.base {
+    reply.Err = ErrCompacted
+    reply.Config = sm.configs[0]
+    sm.mu.Unlock()
+    return nil
+  }
+  if config := sm.Config(args.Num); config != nil {
+    reply.Err = OK
+    reply.Config = *config
+    sm.mu.Unlock()
+    return nil
+  }
+  sm.mu.Unlock()
+
+  if !sm.Sync(Op{ ReqId: nrand(), OpType: OpQuery }) {
+    return nil
+  }
+
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+  reply.Err = OK
+  if config := sm.Config(args.Num); config != nil {
+    reply.Config = *config
+  } else {
+    // not agreed yet, or -1
+    reply.Config = *sm.Latest()
+  }
+  return nil
+}
 
+func (sm *ShardMaster) Report(args *ReportArgs, reply *ReportReply) error {
+  sm.mu.Lock()
+  reported := args.Num <= sm.inUse[args.GID]
+  sm.mu.Unlock()
+  if !reported {
+    sm.Sync(Op{ ReqId: nrand(), OpType: OpReport, GID: args.GID, Num: args.Num })
+  }
+  return nil
+}
+
+func (sm *ShardMaster) Watch(args *WatchArgs, reply *WatchReply) error {
+  timeout := args.Timeout
+  if timeout <= 0 || timeout > WatchTimeout {
+    timeout = WatchTimeout
+  }
+  deadline := time.Now().Add(timeout)
+
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+  for !sm.dead {
+    sm.CatchUp()
+    if sm.Latest().Num > args.Num || time.Now().After(deadline) {
+      break
+    }
+    sm.mu.Unlock()
+    time.Sleep(WatchPoll)
+    sm.mu.Lock()
+  }
+  reply.Config = *sm.Latest()
   return nil
 }
 
@@ -66,18 +623,36 @@ func (sm *ShardMaster) Kill() {
 // me is the index of the current server in servers[].
 // 
 func StartServer(servers []string, me int) *ShardMaster {
+  return StartServerShards(servers, me, NShards)
+}
+
+//
+// like StartServer(), with nshards shards. all the servers
+// must be started with the same nshards.
+//
+func StartServerShards(servers []string, me int, nshards int) *ShardMaster {
   gob.Register(Op{})
 
   sm := new(ShardMaster)
   sm.me = me
+  sm.servers = servers
 
   sm.configs = make([]Config, 1)
+  sm.configs[0].Shards = make([]int64, nshards)
+  sm.configs[0].Starts = UniformStarts(nshards)
   sm.configs[0].Groups = map[int64][]string{}
+  sm.configs[0].Weights = map[int64]int{}
+  sm.keep = KeepConfigs
+  sm.inUse = make(map[int64]int)
+  sm.leftAt = make(map[int64]int)
+  sm.dups = make(map[int64]int64)
+  sm.applied = -1
 
   rpcs := rpc.NewServer()
   rpcs.Register(sm)
 
   sm.px = paxos.Make(servers, me, rpcs)
+  sm.batcher = paxos.MakeBatcher(sm.px, BatchWindow, sameOp)
 
   os.Remove(servers[me])
   l, e := net.Listen("unix", servers[me]);
@@ -4,9 +4,10 @@ import "testing"
 import "runtime"
 import "strconv"
 import "os"
-// import "time"
+import "time"
 import "fmt"
 import "math/rand"
+import "sync"
 
 func port(tag string, host int) string {
   s := "/var/tmp/824-"
@@ -144,9 +145,14 @@ func TestBasic(t *testing.T) {
     if c.Num != cfa[i].Num {
       t.Fatalf("historical Num wrong")
     }
-    if c.Shards != cfa[i].Shards {
+    if len(c.Shards) != len(cfa[i].Shards) {
       t.Fatalf("historical Shards wrong")
     }
+    for j := 0; j < len(c.Shards); j++ {
+      if c.Shards[j] != cfa[i].Shards[j] {
+        t.Fatalf("historical Shards wrong")
+      }
+    }
     if len(c.Groups) != len(cfa[i].Groups) {
       t.Fatalf("number of historical Groups is wrong")
     }
@@ -359,3 +365,392 @@ func TestFreshQuery(t *testing.T) {
   fmt.Printf("  ... Passed\n")
   os.Remove(portx)
 }
+
+func TestShardCount(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  const nshards = 25
+  var sma []*ShardMaster = make([]*ShardMaster, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(sma)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("count", i)
+  }
+  for i := 0; i < nservers; i++ {
+    sma[i] = StartServerShards(kvh, i, nshards)
+  }
+
+  ck := MakeClerk(kvh)
+
+  fmt.Printf("Test: Configurable number of shards ...\n")
+
+  var gids []int64
+  for gid := int64(1); gid <= 4; gid++ {
+    ck.Join(gid, []string{"a", "b", "c"})
+    gids = append(gids, gid)
+    check(t, gids, ck)
+  }
+  ck.Move(nshards - 1, 1)
+  if ck.Query(-1).Shards[nshards - 1] != 1 {
+    t.Fatalf("Move of the last shard failed")
+  }
+  ck.Leave(2)
+  check(t, []int64{1, 3, 4}, ck)
+
+  for num := 0; num <= ck.Query(-1).Num; num++ {
+    if n := len(ck.Query(num).Shards); n != nshards {
+      t.Fatalf("config %v has %v shards, expected %v", num, n, nshards)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSplitMerge(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var sma []*ShardMaster = make([]*ShardMaster, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(sma)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("split", i)
+  }
+  for i := 0; i < nservers; i++ {
+    sma[i] = StartServer(kvh, i)
+  }
+
+  ck := MakeClerk(kvh)
+
+  fmt.Printf("Test: Split and Merge ...\n")
+
+  ck.Join(1, []string{"a", "b", "c"})
+  ck.Join(2, []string{"d", "e", "f"})
+  ck.Join(3, []string{"g", "h", "i"})
+  c1 := ck.Query(-1)
+
+  const nkeys = 200
+  hot := c1.ShardOf("x")
+  ck.Split(hot)
+  c2 := ck.Query(-1)
+  if len(c2.Shards) != NShards + 1 || c2.Num != c1.Num + 1 {
+    t.Fatalf("Split did not add a shard")
+  }
+  check(t, []int64{1, 2, 3}, ck)
+  moved := 0
+  for i := 0; i < nkeys; i++ {
+    k := strconv.Itoa(i)
+    s1, s2 := c1.ShardOf(k), c2.ShardOf(k)
+    if s1 != hot && s2 != s1 || s1 == hot && s2 != hot && s2 != NShards {
+      t.Fatalf("Split moved key %v from shard %v to %v", k, s1, s2)
+    }
+    if s2 == NShards {
+      moved++
+    }
+  }
+  if moved == 0 {
+    t.Fatalf("Split did not move any keys to the new shard")
+  }
+
+  // a shard that is not next to hot
+  var far int
+  for far = 0; far < NShards; far++ {
+    flo, fhi := c2.Range(far)
+    hlo, hhi := c2.Range(hot)
+    if far != hot && fhi != hlo && hhi != flo {
+      break
+    }
+  }
+  ck.Merge(hot, far)
+  if ck.Query(-1).Num != c2.Num {
+    t.Fatalf("Merge of shards that are not neighbours")
+  }
+
+  ck.Merge(NShards, hot)
+  c3 := ck.Query(-1)
+  if len(c3.Shards) != NShards {
+    t.Fatalf("Merge did not remove a shard")
+  }
+  check(t, []int64{1, 2, 3}, ck)
+  for i := 0; i < nkeys; i++ {
+    k := strconv.Itoa(i)
+    if c1.ShardOf(k) != c3.ShardOf(k) {
+      t.Fatalf("Merge did not undo Split for key %v", k)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Retried Split and Merge are applied once ...\n")
+
+  // as if the reply to the first attempt got lost
+  split := &SplitArgs{ hot, nrand(), 1 }
+  for i := 0; i < nservers; i++ {
+    var reply SplitReply
+    if !call(kvh[i], "ShardMaster.Split", split, &reply) {
+      t.Fatalf("Split RPC failed")
+    }
+  }
+  c4 := ck.Query(-1)
+  if len(c4.Shards) != NShards + 1 || c4.Num != c3.Num + 1 {
+    t.Fatalf("retried Split applied %v times", c4.Num - c3.Num)
+  }
+
+  merge := &MergeArgs{ NShards, hot, split.ClientId, 2 }
+  for i := 0; i < nservers; i++ {
+    var reply MergeReply
+    if !call(kvh[i], "ShardMaster.Merge", merge, &reply) {
+      t.Fatalf("Merge RPC failed")
+    }
+  }
+  c5 := ck.Query(-1)
+  if len(c5.Shards) != NShards || c5.Num != c4.Num + 1 {
+    t.Fatalf("retried Merge applied %v times", c5.Num - c4.Num)
+  }
+  // an older request from the same clerk
+  for i := 0; i < nservers; i++ {
+    var reply SplitReply
+    if !call(kvh[i], "ShardMaster.Split", split, &reply) {
+      t.Fatalf("Split RPC failed")
+    }
+  }
+  if ck.Query(-1).Num != c5.Num {
+    t.Fatalf("Split applied after a later Merge")
+  }
+
+  // concurrent calls on one clerk are all applied
+  var wg sync.WaitGroup
+  for i := 0; i < 4; i++ {
+    wg.Add(1)
+    go func(shard int) {
+      defer wg.Done()
+      ck.Split(shard)
+    }(i)
+  }
+  wg.Wait()
+  if n := len(ck.Query(-1).Shards); n != NShards + 4 {
+    t.Fatalf("4 concurrent Splits left %v shards; expected %v", n, NShards + 4)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestWeights(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var sma []*ShardMaster = make([]*ShardMaster, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(sma)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("weights", i)
+  }
+  for i := 0; i < nservers; i++ {
+    sma[i] = StartServer(kvh, i)
+  }
+
+  ck := MakeClerk(kvh)
+
+  counts := func(c Config) map[int64]int {
+    n := map[int64]int{}
+    for _, gid := range c.Shards {
+      n[gid]++
+    }
+    return n
+  }
+
+  fmt.Printf("Test: Shards in proportion to weight ...\n")
+
+  ck.JoinWeighted(1, []string{"a", "b", "c"}, 1)
+  ck.JoinWeighted(2, []string{"d", "e", "f"}, 4)
+  c1 := ck.Query(-1)
+  if n := counts(c1); n[1] != 2 || n[2] != 8 {
+    t.Fatalf("weights 1:4 gave %v:%v shards", n[1], n[2])
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: SetWeight moves few shards ...\n")
+
+  ck.SetWeight(1, 4)
+  c2 := ck.Query(-1)
+  if c2.Num != c1.Num + 1 || c2.Weights[1] != 4 {
+    t.Fatalf("SetWeight did not make a new config")
+  }
+  check(t, []int64{1, 2}, ck)
+  for shard := range c1.Shards {
+    if c1.Shards[shard] == 1 && c2.Shards[shard] != 1 {
+      t.Fatalf("shard %v moved away from the group that gained weight", shard)
+    }
+  }
+
+  // unknown groups, bad and unchanged weights
+  ck.SetWeight(3, 2)
+  ck.SetWeight(1, 0)
+  ck.SetWeight(1, 4)
+  if ck.Query(-1).Num != c2.Num {
+    t.Fatalf("SetWeight that changes nothing made a new config")
+  }
+
+  ck.Join(3, []string{"g", "h", "i"})
+  if n := counts(ck.Query(-1)); n[3] != 1 {
+    t.Fatalf("weights 4:4:1 gave group 3 %v shards", n[3])
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestWatch(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var sma []*ShardMaster = make([]*ShardMaster, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(sma)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("watch", i)
+  }
+  for i := 0; i < nservers; i++ {
+    sma[i] = StartServer(kvh, i)
+  }
+
+  ck := MakeClerk(kvh)
+
+  fmt.Printf("Test: Watch times out without a new config ...\n")
+
+  start := time.Now()
+  c := ck.Watch(0, 500 * time.Millisecond)
+  if c.Num != 0 {
+    t.Fatalf("Watch returned config %v, expected 0", c.Num)
+  }
+  if d := time.Since(start); d < 400 * time.Millisecond || d > 2 * time.Second {
+    t.Fatalf("Watch with a 500ms timeout took %v", d)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Watch returns when a config is agreed ...\n")
+
+  // each Watch asks another server, so that some of them
+  // learn of the Join from the other servers' decisions
+  for i := 0; i < nservers; i++ {
+    done := make(chan Config)
+    go func() {
+      done <- MakeClerk([]string{kvh[i]}).Watch(i, 0)
+    }()
+    time.Sleep(100 * time.Millisecond)
+    ck.Join(int64(i + 1), []string{"a"})
+    select {
+    case c := <-done:
+      if c.Num != i + 1 {
+        t.Fatalf("Watch(%v) returned config %v", i, c.Num)
+      }
+    case <-time.After(WatchTimeout / 2):
+      t.Fatalf("Watch(%v) did not return after a Join", i)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Subscribe sends every new config ...\n")
+
+  stop := make(chan bool)
+  ch := ck.Subscribe(nservers, stop)
+  ck.Leave(1)
+  ck.Leave(2)
+  ck.Move(0, 3)
+  for num := nservers + 1; num <= nservers + 3; num++ {
+    select {
+    case c := <-ch:
+      if c.Num != num {
+        t.Fatalf("Subscribe sent config %v, expected %v", c.Num, num)
+      }
+    case <-time.After(WatchTimeout):
+      t.Fatalf("Subscribe did not send config %v", num)
+    }
+  }
+  close(stop)
+  for range ch {
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestCompaction(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  const keep = 3
+  var sma []*ShardMaster = make([]*ShardMaster, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(sma)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("compact", i)
+  }
+  for i := 0; i < nservers; i++ {
+    sma[i] = StartServer(kvh, i)
+    sma[i].keep = keep
+  }
+
+  ck := MakeClerk(kvh)
+
+  // the configs below num are dropped, num is kept
+  compacted := func(num int) {
+    if num > 0 {
+      c, err := ck.QueryErr(num - 1)
+      if err != ErrCompacted || c.Num != num {
+        t.Fatalf("Query(%v) = %v, %v; expected %v, config %v",
+                 num - 1, err, c.Num, ErrCompacted, num)
+      }
+      if ck.Query(num - 1).Num != -1 {
+        t.Fatalf("Query(%v) of a dropped config", num - 1)
+      }
+    }
+    if c, err := ck.QueryErr(num); err != OK || c.Num != num {
+      t.Fatalf("Query(%v) = %v, %v", num, err, c.Num)
+    }
+  }
+  moves := func(n int) {
+    for i := 0; i < n; i++ {
+      ck.Move(i % NShards, 1)
+    }
+  }
+
+  fmt.Printf("Test: Configs in use are kept ...\n")
+
+  ck.Join(1, []string{"a"})
+  ck.Join(2, []string{"b"})
+  moves(5)
+  compacted(0)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Configs are dropped as groups report ...\n")
+
+  ck.Report(1, 7)
+  ck.Report(2, 7)
+  compacted(7 - keep + 1)
+
+  // a group that left holds on to its configs until it
+  // has applied the config it left in
+  ck.Leave(2)
+  moves(4)
+  ck.Report(1, 12)
+  ck.Report(2, 7)
+  compacted(7)
+  ck.Report(2, 8)
+  compacted(12 - keep + 1)
+
+  // unknown groups do not hold on to anything
+  ck.Report(3, 0)
+  moves(1)
+  compacted(13 - keep + 1)
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -2,6 +2,7 @@ package viewservice
 
 import "net/rpc"
 import "fmt"
+import "sync"
 
 //
 // the viewservice Clerk lives in the client
@@ -9,13 +10,24 @@ import "fmt"
 //
 type Clerk struct {
   me string      // client's name (host:port)
-  server string  // viewservice's host:port
+  servers []string  // viewservice replicas' host:port
+  mu sync.Mutex
+  // the replica that answered last, which is tried first
+  last int
 }
 
 func MakeClerk(me string, server string) *Clerk {
+  return MakeClerkReplicas(me, []string{ server })
+}
+
+//
+// a Clerk of a view service with several replicas; see
+// StartReplica().
+//
+func MakeClerkReplicas(me string, servers []string) *Clerk {
   ck := new(Clerk)
   ck.me = me
-  ck.server = server
+  ck.servers = servers
   return ck
 }
 
@@ -50,6 +62,26 @@ func call(srv string, rpcname string,
   return false
 }
 
+//
+// send an RPC to each replica in turn, starting with the
+// one that answered last, until one does.
+//
+func (ck *Clerk) callAny(rpcname string, args interface{}, reply interface{}) bool {
+  ck.mu.Lock()
+  last := ck.last
+  ck.mu.Unlock()
+  for i := range ck.servers {
+    srv := (last + i) % len(ck.servers)
+    if call(ck.servers[srv], rpcname, args, reply) {
+      ck.mu.Lock()
+      ck.last = srv
+      ck.mu.Unlock()
+      return true
+    }
+  }
+  return false
+}
+
 func (ck *Clerk) Ping(viewnum uint) (View, error) {
   // prepare the arguments.
   args := &PingArgs{}
@@ -58,7 +90,7 @@ func (ck *Clerk) Ping(viewnum uint) (View, error) {
   var reply PingReply
 
   // send an RPC request, wait for the reply.
-  ok := call(ck.server, "ViewServer.Ping", args, &reply)
+  ok := ck.callAny("ViewServer.Ping", args, &reply)
   if ok == false {
     return View{}, fmt.Errorf("Ping(%v) failed", viewnum)
   }
@@ -78,7 +110,7 @@ func (ck *Clerk) Get() (View, bool) {
   args := &GetArgs{}
   args.Me = ck.me
   var reply GetReply
-  ok := call(ck.server, "ViewServer.Get", args, &reply)
+  ok := ck.callAny("ViewServer.Get", args, &reply)
   if ok == false {
     return View{}, false
   }
@@ -94,6 +126,13 @@ func (ck *Clerk) Get() (View, bool) {
   return reply.View, true
 }
 
+func (ck *Clerk) Status() (StatusReply, bool) {
+  args := &StatusArgs{}
+  var reply StatusReply
+  ok := ck.callAny("ViewServer.Status", args, &reply)
+  return reply, ok
+}
+
 func (ck *Clerk) Primary() string {
   v, ok := ck.Get()
   if ok {
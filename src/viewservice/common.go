@@ -3,17 +3,20 @@ package viewservice
 import "time"
 
 //
-// This is a non-replicated view service for a simple
-// primary/backup system.
+// This is a view service for a simple primary/backup
+// system. It may run as one server, or as several replicas
+// that agree on its state through Paxos (see replica.go);
+// Pings and Gets work the same either way.
 //
 // The view service goes through a sequence of numbered
-// views, each with a primary and (if possible) a backup.
+// views, each with a primary and (if possible) as many
+// backups as the replication factor it was started with.
 // A view consists of a view number and the host:port of
 // the view's primary and backup p/b servers.
 //
 // The primary in a view is always either the primary
-// or the backup of the previous view (in order to ensure
-// that the p/b service's state is preserved).
+// or one of the backups of the previous view (in order to
+// ensure that the p/b service's state is preserved).
 //
 // Each p/b server should send a Ping RPC once per PingInterval.
 // The view server replies with a description of the current
@@ -23,8 +26,8 @@ import "time"
 // that the p/b server knows about.
 //
 // The view server proceeds to a new view when either it hasn't
-// received a ping from the primary or backup for a while, or
-// if there was no backup and a new server starts Pinging.
+// received a ping from the primary or a backup for a while, or
+// if there were too few backups and a new server starts Pinging.
 //
 // The view server will not proceed to a new view until 
 // the primary from the current view acknowledges
@@ -36,9 +39,24 @@ import "time"
 type View struct {
   Viewnum uint
   Primary string
-  Backup string
+  Backup string // Backups[0], or "" if there are none
+  // in the order they are to be promoted in
+  Backups []string
 }
 
+func (view View) IsBackup(server string) bool {
+  for _, b := range view.Backups {
+    if b == server {
+      return true
+    }
+  }
+  return false
+}
+
+// the number of backups a view has if StartServer() is
+// used; see StartServerBackups().
+const DefaultBackups = 1
+
 // clients should send a Ping RPC this often,
 // to tell the viewservice that the client is alive.
 const PingInterval = time.Millisecond * 100
@@ -79,3 +97,17 @@ type GetArgs struct {
 type GetReply struct {
   View View
 }
+
+//
+// Status(): the current view, and the idle servers that are
+// alive, in the order they would be taken as backups. for
+// operators.
+//
+
+type StatusArgs struct {
+}
+
+type StatusReply struct {
+  View View
+  Idle []string
+}
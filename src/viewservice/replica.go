@@ -0,0 +1,132 @@
+package viewservice
+
+//
+// Replicating the view service.
+//
+// A view service of several replicas keeps the same state at
+// each of them by agreeing, through Paxos, on a log of the
+// Pings, Gets and ticks they are sent. Every replica applies
+// the log in order, so each goes through the same views.
+//
+// A Ping or tick carries the time at the replica it was sent
+// to, and the ping tables go by those times rather than by
+// each replica's own clock, so all of them find the same
+// servers dead at the same point in the log. A Get is put in
+// the log too, so that it sees every Ping agreed before it,
+// as with a single view server.
+//
+// A view service of one replica applies each request as it
+// comes, with no Paxos.
+//
+
+import "paxos"
+import "time"
+import "crypto/rand"
+import "math/big"
+
+const (
+  OpPing = "OpPing"
+  OpTick = "OpTick"
+  // orders a Get after the ops agreed before it
+  OpGet = "OpGet"
+)
+
+const (
+  // how long ops are gathered before they are proposed
+  BatchWindow = 2 * time.Millisecond
+)
+
+type Op struct {
+  // tells apart ops with the same arguments
+  ReqId int64
+  Type string
+  Me string
+  Viewnum uint
+  // when the replica that proposed it got it
+  Now time.Time
+}
+
+func sameOp(a interface{}, b interface{}) bool {
+  return a.(Op).ReqId == b.(Op).ReqId
+}
+
+func nrand() int64 {
+  max := big.NewInt(int64(1) << 62)
+  bigx, _ := rand.Int(rand.Reader, max)
+  return bigx.Int64()
+}
+
+//
+// agree on op, apply the log up to and including it, and
+// return the view as of then. returns false if the server
+// died.
+//
+func (vs *ViewServer) Sync(op Op) (View, bool) {
+  if vs.px == nil {
+    vs.mu.Lock()
+    defer vs.mu.Unlock()
+    vs.ApplyOp(op)
+    return vs.current_view(), !vs.dead
+  }
+
+  seq := vs.batcher.Submit(op)
+  if seq < 0 {
+    return View{}, false
+  }
+
+  vs.mu.Lock()
+  defer vs.mu.Unlock()
+  vs.ApplyUpTo(seq)
+  return vs.current_view(), !vs.dead
+}
+
+//
+// apply the log up to and including seq, filling in the
+// instances that are not decided.
+// hold vs.mu before call this func
+//
+func (vs *ViewServer) ApplyUpTo(seq int) {
+  for vs.applied < seq && !vs.dead {
+    next := vs.applied + 1
+    decided, v := vs.WaitLog(next)
+    if !decided {
+      // some peer started next but did not finish
+      vs.px.Start(next, paxos.Batch{})
+      continue
+    }
+    batch, _ := v.(paxos.Batch)
+    for _, x := range batch.Values {
+      vs.ApplyOp(x.(Op))
+    }
+    vs.applied = next
+    vs.px.Done(next)
+  }
+}
+
+//
+// wait a while for seq to be decided.
+//
+func (vs *ViewServer) WaitLog(seq int) (bool, interface{}) {
+  sleep := paxos.ShortWait * time.Millisecond
+  for i := 0; i < 10 && !vs.dead; i++ {
+    decided, v := vs.px.Status(seq)
+    if decided {
+      return true, v
+    }
+    time.Sleep(sleep)
+    if sleep < paxos.LongWait * time.Millisecond {
+      sleep *= 2
+    }
+  }
+  return false, nil
+}
+
+// hold vs.mu before call this func
+func (vs *ViewServer) ApplyOp(op Op) {
+  switch op.Type {
+  case OpPing:
+    vs.ping(&PingArgs{ op.Me, op.Viewnum }, op.Now)
+  case OpTick:
+    vs.check(op.Now)
+  }
+}
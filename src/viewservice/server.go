@@ -7,6 +7,8 @@ import "time"
 import "sync"
 import "fmt"
 import "os"
+import "paxos"
+import "encoding/gob"
 
 type ViewServer struct {
   mu sync.Mutex
@@ -19,7 +21,27 @@ type ViewServer struct {
   lastPingTime map[string]time.Time
   lastPingViewnum map[string]uint
   acked_viewnum uint
-  idle_server string
+  // the servers that ping but are in no view, in the order
+  // they started pinging
+  idle []string
+  // the latest time a Ping or tick was made at
+  clock time.Time
+  // the replication factor: how many backups a view may have
+  nbackups int
+  // the latest view each server has acknowledged, and the
+  // view in which each backup was added; a backup is up to
+  // date once it has acknowledged the view that added it
+  acked map[string]uint
+  added map[string]uint
+  // the servers of the view that restarted, which leave it
+  // with the next view
+  lost map[string]bool
+  // with more than one replica, all of the above is kept the
+  // same at each of them through Paxos; see replica.go
+  px *paxos.Paxos
+  batcher *paxos.Batcher
+  // the seq number of the latest applied log instance
+  applied int
 }
 
 func (vs *ViewServer) update_viewnum() {
@@ -32,40 +54,89 @@ func (vs *ViewServer) current_view() View {
 	return vs.current
 }
 
+// a View is handed out in replies, so the list is never
+// changed in place.
+func (vs *ViewServer) set_backups(backups []string) {
+  vs.current.Backups = backups
+  if len(backups) > 0 {
+    vs.current.Backup = backups[0]
+  } else {
+    vs.current.Backup = ""
+  }
+}
+
+// has server pinged within the last DeadPings intervals?
+func (vs *ViewServer) alive(server string) bool {
+  pingTime, ok := vs.lastPingTime[server]
+  return ok && vs.clock.Sub(pingTime) <= PingInterval * DeadPings
+}
+
+func (vs *ViewServer) up_to_date(server string) bool {
+  return vs.alive(server) && vs.acked[server] >= vs.added[server]
+}
+
+func (vs *ViewServer) is_idle(server string) bool {
+  for _, s := range vs.idle {
+    if s == server {
+      return true
+    }
+  }
+  return false
+}
+
+//
+// take the idle server that has been in the pool longest
+// and is alive out of the pool; "" if there is none.
+//
+func (vs *ViewServer) take_idle() string {
+  for i, server := range vs.idle {
+    if vs.alive(server) {
+      vs.idle = append(append([]string{}, vs.idle[:i]...), vs.idle[i+1:]...)
+      return server
+    }
+  }
+  return ""
+}
+
 //
 // server Ping RPC handler.
 //
 func (vs *ViewServer) Ping(args *PingArgs, reply *PingReply) error {
-  vs.mu.Lock()
-  defer vs.mu.Unlock()
+  view, ok := vs.Sync(Op{ ReqId: nrand(), Type: OpPing, Me: args.Me,
+    Viewnum: args.Viewnum, Now: time.Now() })
+  if !ok {
+    return fmt.Errorf("ViewServer(%v) is dead", vs.me)
+  }
+  // send view
+  reply.View = view
+  return nil
+}
 
+//
+// a server pinged at now.
+// hold vs.mu before call this func
+//
+func (vs *ViewServer) ping(args *PingArgs, now time.Time) {
 	// fmt.Printf("args> %s: , viewnum: %d, \n",  args.Me, args.Viewnum)
 
+  // a server in the view that pings 0 after it acknowledged
+  // a view has restarted and lost its state
+  if args.Viewnum == 0 && vs.acked[args.Me] != 0 &&
+     (args.Me == vs.current.Primary || vs.current.IsBackup(args.Me)) {
+    vs.lost[args.Me] = true
+  }
+
   // update heartbeat stats
-  vs.lastPingTime[args.Me] = time.Now()
+  if now.After(vs.clock) {
+    vs.clock = now
+  }
+  vs.lastPingTime[args.Me] = now
   vs.lastPingViewnum[args.Me] = args.Viewnum
+  vs.acked[args.Me] = args.Viewnum
   // add an idle server
   if args.Me != vs.current.Primary &&
-     args.Me != vs.current.Backup {
-    vs.idle_server = args.Me
-  }
-
-  if vs.current.Primary == "" {
-		// add the first primary server
-		if vs.idle_server != "" {
-      vs.current.Primary = vs.idle_server
-			vs.idle_server = ""
-			vs.update_viewnum()
-    }
-  } else if vs.current.Backup == "" {
-		// add a backup server
-		vs.replace_backup()
-  } else if args.Me == vs.current.Primary && args.Viewnum == 0 {
-		// replace primary server if it restarts
-		vs.replace_primary()
-  } else if args.Me == vs.current.Backup && args.Viewnum == 0 {
-		// replace backup server if it restarts
-    vs.replace_backup()
+     !vs.current.IsBackup(args.Me) && !vs.is_idle(args.Me) {
+    vs.idle = append(vs.idle, args.Me)
   }
 
 	// update view after acknowledge
@@ -74,62 +145,138 @@ func (vs *ViewServer) Ping(args *PingArgs, reply *PingReply) error {
 			vs.acked_viewnum = vs.current.Viewnum
 		}
 	}
-  // send view
-	reply.View = vs.current_view()
-  return nil
+
+  vs.advance()
 }
 
 // 
 // server Get() RPC handler.
 //
 func (vs *ViewServer) Get(args *GetArgs, reply *GetReply) error {
-	reply.View = vs.current
+  view, ok := vs.Sync(Op{ ReqId: nrand(), Type: OpGet })
+  if !ok {
+    return fmt.Errorf("ViewServer(%v) is dead", vs.me)
+  }
+	reply.View = view
   // fmt.Printf("Server Get p: %s, b: %s, num: %d\n",
   //          reply.View.Primary, reply.View.Backup, reply.View.Viewnum)
   return nil
 }
 
-func (vs *ViewServer) replace_primary() bool {
-  // primary in each view must acknowledge that view to viewserver
-  // viewserver must stay with current view until acknowledged
-  // even if the primary seems to have failed
-  // no point in proceeding since not acked == backup may not be initialized
+//
+// server Status() RPC handler.
+//
+func (vs *ViewServer) Status(args *StatusArgs, reply *StatusReply) error {
+  if _, ok := vs.Sync(Op{ ReqId: nrand(), Type: OpGet }); !ok {
+    return fmt.Errorf("ViewServer(%v) is dead", vs.me)
+  }
+  vs.mu.Lock()
+  defer vs.mu.Unlock()
+  reply.View = vs.current_view()
+  for _, server := range vs.idle {
+    if vs.alive(server) {
+      reply.Idle = append(reply.Idle, server)
+    }
+  }
+  return nil
+}
+
+//
+// move to the next view if the current one calls for it:
+// the primary is dead or restarted, a backup is, or there are
+// too few backups and an idle server to add. all of it goes
+// into one new view.
+//
+// the view does not change until its primary has acknowledged
+// it, even if the primary seems to have failed: until then the
+// primary may not know it is primary, and a backup may not be
+// initialized, so there might be two primaries or a primary
+// without the state. only the very first view, which has no
+// primary, is not waited for.
+// hold vs.mu before call this func
+//
+func (vs *ViewServer) advance() {
+  if vs.current.Primary == "" {
+		// add the first primary server
+		if primary := vs.take_idle(); primary != "" {
+      vs.current.Primary = primary
+			vs.update_viewnum()
+    }
+    return
+  }
   if vs.acked_viewnum != vs.current.Viewnum {
-    fmt.Printf("warning: cannot promote a backup that is not up-to-date\n")
-    return false
+    return
   }
 
-  if vs.current.Backup == "" {
-		fmt.Printf("fatal error: need to replace primary but get no backup\n")
-		return false
-	}
+  // the backups that are still there
+  backups := []string{}
+  for _, b := range vs.current.Backups {
+    if vs.alive(b) && !vs.lost[b] {
+      backups = append(backups, b)
+    }
+  }
 
-  fmt.Printf("replace primary, old: %s, new: %s, viewnum: %d\n",
-    vs.current.Primary, vs.current.Backup, vs.current.Viewnum)
-  vs.current.Primary = vs.current.Backup
+  primary := vs.current.Primary
+  if !vs.alive(primary) || vs.lost[primary] {
+    // promote the first backup that is up to date; the
+    // others stay backups, in the same order
+    next := -1
+    for i, b := range backups {
+      if vs.up_to_date(b) {
+        next = i
+        break
+      }
+    }
+    if next >= 0 {
+      fmt.Printf("replace primary, old: %s, new: %s, viewnum: %d\n",
+        primary, backups[next], vs.current.Viewnum)
+      primary = backups[next]
+      backups = append(append([]string{}, backups[:next]...), backups[next+1:]...)
+    } else if vs.alive(primary) && len(backups) == 0 {
+      // nothing better than a restarted primary
+      fmt.Printf("warning: primary %s restarted and no backup is up-to-date\n", primary)
+      delete(vs.lost, primary)
+    } else {
+      fmt.Printf("fatal error: need to replace primary but get no up-to-date backup\n")
+      return
+    }
+  }
 
-  if vs.idle_server != "" {
-		vs.current.Backup = vs.idle_server
-		vs.idle_server = ""
-	} else {
-		vs.current.Backup = ""
-	}
-	vs.update_viewnum()
-	return true
-}
-
-func (vs *ViewServer) replace_backup() bool {
-  if vs.idle_server != "" {
-		fmt.Printf("replace backup, old: %s, new: %s, viewnum: %d\n",
-			vs.current.Backup, vs.idle_server, vs.current.Viewnum)
-    vs.current.Backup = vs.idle_server
-		vs.idle_server = ""
-		vs.update_viewnum()
-		return true
-	} else {
-		vs.current.Backup = ""
-		return false
-	}
+  for len(backups) < vs.nbackups {
+    server := vs.take_idle()
+    if server == "" {
+      break
+    }
+    fmt.Printf("add backup: %s, viewnum: %d\n", server, vs.current.Viewnum)
+    backups = append(backups, server)
+    vs.added[server] = vs.current.Viewnum + 1
+  }
+
+  if primary == vs.current.Primary && len(backups) == len(vs.current.Backups) {
+    same := true
+    for i := range backups {
+      same = same && backups[i] == vs.current.Backups[i]
+    }
+    if same {
+      return
+    }
+  }
+
+  // forget the servers that leave the view
+  if primary != vs.current.Primary {
+    delete(vs.lost, vs.current.Primary)
+  }
+  next := View{ Primary: primary, Backups: backups }
+  for _, b := range vs.current.Backups {
+    if b != primary && !next.IsBackup(b) {
+      fmt.Printf("remove backup: %s, viewnum: %d\n", b, vs.current.Viewnum)
+      delete(vs.added, b)
+      delete(vs.lost, b)
+    }
+  }
+  vs.current.Primary = primary
+  vs.set_backups(backups)
+  vs.update_viewnum()
 }
 
 //
@@ -138,23 +285,35 @@ func (vs *ViewServer) replace_backup() bool {
 // accordingly.
 //
 func (vs *ViewServer) tick() {
-  vs.mu.Lock()
-  defer vs.mu.Unlock()
+  vs.Sync(Op{ ReqId: nrand(), Type: OpTick, Now: time.Now() })
+}
 
-  now := time.Now()
+//
+// notice the servers that have not pinged for a while
+// before now.
+// hold vs.mu before call this func
+//
+func (vs *ViewServer) check(now time.Time) {
+  if now.After(vs.clock) {
+    vs.clock = now
+  }
 
   for server, pingTime := range vs.lastPingTime {
     if now.Sub(pingTime) > PingInterval * DeadPings {
       delete(vs.lastPingTime, server)
       delete(vs.lastPingViewnum, server)
-      if server == vs.current.Primary {
-        vs.replace_primary()
-      }
-      if server == vs.current.Backup {
-        vs.replace_backup()
-      }
+      delete(vs.acked, server)
     }
   }
+  idle := []string{}
+  for _, server := range vs.idle {
+    if _, ok := vs.lastPingTime[server]; ok {
+      idle = append(idle, server)
+    }
+  }
+  vs.idle = idle
+
+  vs.advance()
 }
 
 //
@@ -165,19 +324,60 @@ func (vs *ViewServer) tick() {
 func (vs *ViewServer) Kill() {
   vs.dead = true
   vs.l.Close()
+  if vs.px != nil {
+    vs.px.Kill()
+  }
 }
 
-func StartServer(me string) *ViewServer {
+//
+// a view server with no views yet, that does not serve RPCs.
+//
+func makeViewServer(me string, nbackups int) *ViewServer {
   vs := new(ViewServer)
   vs.me = me
   // Your vs.* initializations here.
   vs.lastPingTime = make(map[string]time.Time)
   vs.lastPingViewnum = make(map[string]uint)
+  vs.nbackups = nbackups
+  vs.acked = make(map[string]uint)
+  vs.added = make(map[string]uint)
+  vs.lost = make(map[string]bool)
+  return vs
+}
+
+func StartServer(me string) *ViewServer {
+  return StartServerBackups(me, DefaultBackups)
+}
+
+//
+// like StartServer(), but the views have up to nbackups
+// backups.
+//
+func StartServerBackups(me string, nbackups int) *ViewServer {
+  return StartReplica([]string{ me }, 0, nbackups)
+}
+
+//
+// servers[] contains the ports of the set of
+// servers that will cooperate via Paxos to
+// form the fault-tolerant view service.
+// me is the index of the current server in servers[].
+// a view has up to nbackups backups.
+//
+func StartReplica(servers []string, me int, nbackups int) *ViewServer {
+  gob.Register(Op{})
+
+  vs := makeViewServer(servers[me], nbackups)
 
   // tell net/rpc about our RPC server and handlers.
   rpcs := rpc.NewServer()
   rpcs.Register(vs)
 
+  if len(servers) > 1 {
+    vs.px = paxos.Make(servers, me, rpcs)
+    vs.batcher = paxos.MakeBatcher(vs.px, BatchWindow, sameOp)
+  }
+
   // prepare to receive connections from clients.
   // change "unix" to "tcp" to use over a network.
   os.Remove(vs.me) // only needed for "unix"
@@ -200,7 +400,7 @@ func StartServer(me string) *ViewServer {
         conn.Close()
       }
       if err != nil && vs.dead == false {
-        fmt.Printf("ViewServer(%v) accept: %v\n", me, err.Error())
+        fmt.Printf("ViewServer(%v) accept: %v\n", vs.me, err.Error())
         vs.Kill()
       }
     }
@@ -252,3 +252,396 @@ func Test1(t *testing.T) {
 
   vs.Kill()
 }
+
+// views with two backups; the first backup that is up to
+// date takes over.
+func TestBackups(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  vshost := port("bv")
+  vs := StartServerBackups(vshost, 2)
+
+  ck1 := MakeClerk(port("b1"), vshost)
+  ck2 := MakeClerk(port("b2"), vshost)
+  ck3 := MakeClerk(port("b3"), vshost)
+  ck4 := MakeClerk(port("b4"), vshost)
+
+  fmt.Printf("Test: Two backups ...\n")
+
+  // each pings with the view it knows, as a p/b server does
+  views := map[*Clerk]uint{}
+  ping := func(cks ...*Clerk) View {
+    var v View
+    for _, ck := range cks {
+      v, _ = ck.Ping(views[ck])
+      views[ck] = v.Viewnum
+    }
+    return v
+  }
+
+  for i := 0; i < DeadPings * 3; i++ {
+    v := ping(ck1, ck2, ck3)
+    if len(v.Backups) == 2 && v.Viewnum == views[ck1] {
+      break
+    }
+    time.Sleep(PingInterval)
+  }
+  // acknowledge the view
+  ping(ck1, ck2, ck3)
+  v, _ := ck1.Get()
+  if v.Primary != ck1.me || len(v.Backups) != 2 ||
+     v.Backups[0] != ck2.me || v.Backups[1] != ck3.me {
+    t.Fatalf("wanted %v [%v %v], got %v %v", ck1.me, ck2.me, ck3.me, v.Primary, v.Backups)
+  }
+  if v.Backup != ck2.me {
+    t.Fatalf("wanted backup %v, got %v", ck2.me, v.Backup)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Primary and first backup fail together ...\n")
+
+  vx := v
+  for i := 0; i < DeadPings * 3; i++ {
+    v = ping(ck3)
+    if v.Primary != ck1.me {
+      break
+    }
+    time.Sleep(PingInterval)
+  }
+  v, _ = ck3.Get()
+  if v.Primary != ck3.me || len(v.Backups) != 0 {
+    t.Fatalf("wanted %v [], got %v %v", ck3.me, v.Primary, v.Backups)
+  }
+  if v.Viewnum <= vx.Viewnum {
+    t.Fatalf("view did not change")
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Restarted backup is replaced ...\n")
+
+  for i := 0; i < DeadPings * 3; i++ {
+    v = ping(ck3, ck4, ck1)
+    if len(v.Backups) == 2 && v.Viewnum == views[ck3] {
+      break
+    }
+    time.Sleep(PingInterval)
+  }
+  ping(ck3, ck4, ck1)
+  v, _ = ck3.Get()
+  if v.Primary != ck3.me || len(v.Backups) != 2 ||
+     v.Backups[0] != ck4.me || v.Backups[1] != ck1.me {
+    t.Fatalf("wanted %v [%v %v], got %v %v", ck3.me, ck4.me, ck1.me, v.Primary, v.Backups)
+  }
+
+  // ck4 restarts: it leaves the view, and the next backup
+  // to take over is ck1
+  views[ck4] = 0
+  for i := 0; i < DeadPings * 3; i++ {
+    v = ping(ck3, ck4, ck1)
+    if !v.IsBackup(ck4.me) {
+      break
+    }
+    time.Sleep(PingInterval)
+  }
+  if v.IsBackup(ck4.me) || v.Backup != ck1.me {
+    t.Fatalf("wanted backup %v first, got %v", ck1.me, v.Backups)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  vs.Kill()
+}
+
+// three view service replicas, two of which fail in turn.
+func TestReplicated(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nreplicas = 3
+  var vshosts []string
+  for i := 0; i < nreplicas; i++ {
+    vshosts = append(vshosts, port("rv" + strconv.Itoa(i)))
+  }
+  var vss []*ViewServer
+  for i := 0; i < nreplicas; i++ {
+    vss = append(vss, StartReplica(vshosts, i, 1))
+  }
+
+  ck1 := MakeClerkReplicas(port("r1"), vshosts)
+  ck2 := MakeClerkReplicas(port("r2"), vshosts)
+  ck3 := MakeClerkReplicas(port("r3"), vshosts)
+
+  fmt.Printf("Test: Replicated view service forms a view ...\n")
+
+  for i := 0; i < DeadPings * 3; i++ {
+    v1, _ := ck1.Get()
+    ck1.Ping(v1.Viewnum)
+    ck2.Ping(0)
+    v, _ := ck1.Get()
+    if v.Backup == ck2.me && v1.Viewnum == v.Viewnum {
+      break
+    }
+    time.Sleep(PingInterval)
+  }
+  vx, _ := ck1.Get()
+  ck1.Ping(vx.Viewnum)
+  check(t, ck1, ck1.me, ck2.me, 0)
+
+  // every replica has gone through the same views
+  for i := 0; i < nreplicas; i++ {
+    v, _ := MakeClerk("", vshosts[i]).Get()
+    if v.Primary != ck1.me || v.Backup != ck2.me || v.Viewnum != vx.Viewnum {
+      t.Fatalf("replica %v has view %v, expected %v", i, v, vx)
+    }
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Backup takes over after a replica fails ...\n")
+
+  vss[0].Kill()
+  for i := 0; i < DeadPings * 3; i++ {
+    ck2.Ping(vx.Viewnum)
+    ck3.Ping(0)
+    v, _ := ck2.Get()
+    if v.Primary == ck2.me {
+      break
+    }
+    time.Sleep(PingInterval)
+  }
+  check(t, ck2, ck2.me, ck3.me, vx.Viewnum + 1)
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Replicas that are left agree ...\n")
+
+  vy, _ := ck2.Get()
+  for i := 1; i < nreplicas; i++ {
+    v, _ := MakeClerk("", vshosts[i]).Get()
+    if v.Primary != vy.Primary || v.Backup != vy.Backup || v.Viewnum != vy.Viewnum {
+      t.Fatalf("replica %v has view %v, expected %v", i, v, vy)
+    }
+  }
+  fmt.Printf("  ... Passed\n")
+
+  for i := 0; i < nreplicas; i++ {
+    vss[i].Kill()
+  }
+}
+
+// spares wait in a pool, in the order they came; a dead
+// one leaves it.
+func TestIdlePool(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  vshost := port("iv")
+  vs := StartServer(vshost)
+
+  ck1 := MakeClerk(port("i1"), vshost)
+  ck2 := MakeClerk(port("i2"), vshost)
+  ck3 := MakeClerk(port("i3"), vshost)
+  ck4 := MakeClerk(port("i4"), vshost)
+
+  views := map[*Clerk]uint{}
+  ping := func(cks ...*Clerk) {
+    for _, ck := range cks {
+      v, _ := ck.Ping(views[ck])
+      views[ck] = v.Viewnum
+    }
+  }
+
+  fmt.Printf("Test: Idle servers are listed in order ...\n")
+
+  for i := 0; i < DeadPings * 2; i++ {
+    ping(ck1, ck2)
+    time.Sleep(PingInterval)
+  }
+  check(t, ck1, ck1.me, ck2.me, 0)
+  ping(ck1, ck2, ck3)
+  ping(ck4)
+  st, _ := ck1.Status()
+  if len(st.Idle) != 2 || st.Idle[0] != ck3.me || st.Idle[1] != ck4.me {
+    t.Fatalf("wanted idle [%v %v], got %v", ck3.me, ck4.me, st.Idle)
+  }
+  if st.View.Primary != ck1.me {
+    t.Fatalf("wanted primary %v, got %v", ck1.me, st.View.Primary)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Dead idle server leaves the pool ...\n")
+
+  for i := 0; i < DeadPings * 2; i++ {
+    ping(ck1, ck2, ck4)
+    time.Sleep(PingInterval)
+  }
+  st, _ = ck1.Status()
+  if len(st.Idle) != 1 || st.Idle[0] != ck4.me {
+    t.Fatalf("wanted idle [%v], got %v", ck4.me, st.Idle)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Live idle server replaces a dead backup ...\n")
+
+  // ck3 comes back, after ck4
+  for i := 0; i < DeadPings * 3; i++ {
+    ping(ck1, ck4, ck3)
+    v, _ := ck1.Get()
+    if v.Backup != ck2.me {
+      break
+    }
+    time.Sleep(PingInterval)
+  }
+  v, _ := ck1.Get()
+  if v.Backup != ck4.me {
+    t.Fatalf("wanted backup %v, got %v", ck4.me, v.Backup)
+  }
+  st, _ = ck1.Status()
+  if len(st.Idle) != 1 || st.Idle[0] != ck3.me {
+    t.Fatalf("wanted idle [%v], got %v", ck3.me, st.Idle)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  vs.Kill()
+}
+
+//
+// drives the view state machine of a server that serves no
+// RPCs, with made up times, one step at a time.
+//
+type machine struct {
+  t *testing.T
+  vs *ViewServer
+  now time.Time
+}
+
+func makeMachine(t *testing.T) *machine {
+  return &machine{ t, makeViewServer("", 1), time.Now() }
+}
+
+func (m *machine) ping(me string, viewnum uint) {
+  m.vs.ping(&PingArgs{ me, viewnum }, m.now)
+}
+
+// time passes, the servers in alive pinging with the view
+// they last saw, as if the view did not change.
+func (m *machine) pass(d time.Duration, alive ...string) {
+  end := m.now.Add(d)
+  for m.now.Before(end) {
+    m.now = m.now.Add(PingInterval)
+    for _, me := range alive {
+      m.ping(me, m.vs.lastPingViewnum[me])
+    }
+    m.vs.check(m.now)
+  }
+}
+
+func (m *machine) want(primary string, backup string, n uint) {
+  v := m.vs.current
+  if v.Primary != primary || v.Backup != backup || v.Viewnum != n {
+    m.t.Fatalf("wanted %v/%v/%v, got %v/%v/%v", primary, backup, n,
+      v.Primary, v.Backup, v.Viewnum)
+  }
+  if len(v.Backups) > 1 || backup != "" && len(v.Backups) != 1 ||
+     backup == "" && len(v.Backups) != 0 {
+    m.t.Fatalf("wanted backups [%v], got %v", backup, v.Backups)
+  }
+}
+
+// a primary, and a backup that has acknowledged view 2.
+func (m *machine) setup() {
+  m.ping("a", 0)
+  m.want("a", "", 1)
+  m.ping("a", 1)
+  m.ping("b", 0)
+  m.want("a", "b", 2)
+  m.ping("a", 2)
+  m.ping("b", 2)
+}
+
+func TestTransitions(t *testing.T) {
+  fmt.Printf("Test: Restarted primary is replaced by the backup ...\n")
+  {
+    m := makeMachine(t)
+    m.setup()
+    m.ping("a", 0)
+    m.want("b", "", 3)
+    // a is idle now, and becomes backup once b acks
+    m.ping("a", 0)
+    m.want("b", "", 3)
+    m.ping("b", 3)
+    m.want("b", "a", 4)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Restarted primary, backup not up-to-date ...\n")
+  {
+    m := makeMachine(t)
+    m.ping("a", 0)
+    m.ping("a", 1)
+    m.ping("b", 0)
+    m.want("a", "b", 2)
+    m.ping("a", 2)
+    // b has not acknowledged being backup
+    m.ping("a", 0)
+    m.want("a", "b", 2)
+    m.ping("b", 2)
+    m.want("b", "", 3)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Restarted backup is replaced by an idle server ...\n")
+  {
+    m := makeMachine(t)
+    m.setup()
+    m.ping("c", 2)
+    m.want("a", "b", 2)
+    m.ping("b", 0)
+    m.want("a", "c", 3)
+    // b waits in the pool
+    m.ping("a", 3)
+    m.ping("b", 0)
+    m.want("a", "c", 3)
+    if !m.vs.is_idle("b") {
+      t.Fatalf("restarted backup not idle")
+    }
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Backup dies before the primary acks ...\n")
+  {
+    m := makeMachine(t)
+    m.ping("a", 0)
+    m.ping("a", 1)
+    m.ping("b", 0)
+    m.want("a", "b", 2)
+    // a keeps pinging view 1, b is silent
+    m.pass(PingInterval * DeadPings * 2, "a")
+    m.want("a", "b", 2)
+    m.ping("a", 2)
+    m.want("a", "", 3)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Idle server arrives before the primary acks ...\n")
+  {
+    m := makeMachine(t)
+    m.ping("a", 0)
+    m.want("a", "", 1)
+    m.ping("c", 0)
+    m.want("a", "", 1)
+    m.pass(PingInterval * DeadPings * 2, "a", "c")
+    m.want("a", "", 1)
+    m.ping("a", 1)
+    m.want("a", "c", 2)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Primary dies before it acks ...\n")
+  {
+    m := makeMachine(t)
+    m.setup()
+    m.ping("c", 2)
+    m.ping("b", 0)
+    m.want("a", "c", 3)
+    // a never acks view 3; c must not be promoted
+    m.pass(PingInterval * DeadPings * 2, "c")
+    m.want("a", "c", 3)
+  }
+  fmt.Printf("  ... Passed\n")
+}